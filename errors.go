@@ -3,6 +3,10 @@ package gae
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/datastore"
 )
 
 var (
@@ -17,6 +21,40 @@ var (
 	ErrUnauth = errors.New("unauthenticated")
 )
 
+// ConflictError is for when an operation conflicts with the current state of
+// a resource, e.g. when the precondition of an update is not met because the
+// resource has been changed by someone else.
+type ConflictError struct {
+	Msg string
+	Err error
+}
+
+// Error for ConflictError returns a string in the format:
+//
+//	Conflict (<msg>) - <error string>
+func (this ConflictError) Error() string {
+	m := "Conflict"
+	if this.Msg != "" {
+		m += " (" + this.Msg + ")"
+	}
+	if this.Err != nil {
+		m += " - " + this.Err.Error()
+	}
+	return m
+}
+
+// Unwrap returns the underlying error so that ConflictError works with
+// `errors.Is` and `errors.As`.
+func (this ConflictError) Unwrap() error {
+	return this.Err
+}
+
+// IsConflictError checks if an error is the `ConflictError` type.
+func IsConflictError(e error) bool {
+	_, ok := e.(ConflictError)
+	return ok
+}
+
 // DuplicateError is for when a duplicate value is present.
 type DuplicateError struct {
 	Msg  string
@@ -129,6 +167,12 @@ func (this JSONUnmarshalError) Error() string {
 	return m
 }
 
+// Unwrap returns the underlying error so that JSONUnmarshalError works with
+// `errors.Is` and `errors.As`.
+func (this JSONUnmarshalError) Unwrap() error {
+	return this.Err
+}
+
 // IsJSONUnmarshalError checks if an error is the `JSONUnmarshalError` type.
 func IsJSONUnmarshalError(e error) bool {
 	_, ok := e.(JSONUnmarshalError)
@@ -209,6 +253,12 @@ func (this NilError) Error() string {
 	return m
 }
 
+// Unwrap returns the underlying error so that NilError works with
+// `errors.Is` and `errors.As`.
+func (this NilError) Unwrap() error {
+	return this.Err
+}
+
 // IsNilError checks if an error is the `NilError` type.
 func IsNilError(e error) bool {
 	_, ok := e.(NilError)
@@ -240,6 +290,12 @@ func (this NotFoundError) Error() string {
 	return m
 }
 
+// Unwrap returns the underlying error so that NotFoundError works with
+// `errors.Is` and `errors.As`.
+func (this NotFoundError) Unwrap() error {
+	return this.Err
+}
+
 // IsNotFoundError checks if an error is the `NotFoundError` type.
 func IsNotFoundError(e error) bool {
 	_, ok := e.(NotFoundError)
@@ -282,6 +338,36 @@ func IsTypeError(e error) bool {
 	return ok
 }
 
+// UnauthorizedError is for when the user is authenticated but is not allowed
+// to perform the operation, e.g. because the user does not have the required
+// role. Use ErrUnauth for when the user is not authenticated.
+type UnauthorizedError struct {
+	Msg string
+}
+
+// Error for UnauthorizedError returns:
+//
+//	Unauthorized
+//
+// or
+//
+//	Unauthorized - <msg>
+//
+// if the `Msg` field is set.
+func (this UnauthorizedError) Error() string {
+	m := "Unauthorized"
+	if this.Msg != "" {
+		m += " - " + this.Msg
+	}
+	return m
+}
+
+// IsUnauthorizedError checks if an error is the `UnauthorizedError` type.
+func IsUnauthorizedError(e error) bool {
+	_, ok := e.(UnauthorizedError)
+	return ok
+}
+
 // ValidityError is for errors in model validation.
 type ValidityError struct {
 	Msg string
@@ -294,8 +380,73 @@ func (e ValidityError) Error() string {
 	return "validation error - " + e.Msg
 }
 
+// ErrorResponses converts the error into one ErrorResponse per validation
+// error, with the error code VALIDATION, in the same way as
+// ValidationErrorResponses.
+//
+// The validation errors are taken from Msg, in which Save and the other
+// saving functions join the errors of the model with ", ". A validation error
+// that itself contains ", " is therefore split into several. Use
+// ValidationErrorResponses on the model if it is available.
+func (e ValidityError) ErrorResponses() []ErrorResponse {
+	msgs := strings.Split(e.Msg, ", ")
+	ers := make([]ErrorResponse, len(msgs))
+	for i, msg := range msgs {
+		ers[i] = ErrorResponse{
+			ErrorCode: "VALIDATION",
+			Message:   msg,
+		}
+	}
+	return ers
+}
+
 // IsValidityError checks if an error is the `ValidityError` type.
 func IsValidityError(e error) bool {
 	_, ok := e.(ValidityError)
 	return ok
 }
+
+// StatusForError maps an error to the HTTP status code that best describes
+// it:
+//
+//   - ErrUnauth: 401 Unauthorized
+//   - UnauthorizedError: 403 Forbidden
+//   - NotFoundError, datastore.ErrNoSuchEntity: 404 Not Found
+//   - ConflictError, DuplicateError: 409 Conflict
+//   - ErrorResponse: its StatusCode if it is set, otherwise 400 Bad Request
+//   - ErrorResponseList: 400 Bad Request
+//   - InsufficientError, InvalidError, JSONUnmarshalError, MismatchError,
+//     MissingError, TypeError, ValidityError: 400 Bad Request
+//   - nil: 200 OK
+//
+// Any other error is mapped to 500 Internal Server Error.
+func StatusForError(e error) int {
+	if e == nil {
+		return http.StatusOK
+	}
+	if e == ErrUnauth {
+		return http.StatusUnauthorized
+	}
+	if e == datastore.ErrNoSuchEntity {
+		return http.StatusNotFound
+	}
+	switch e := e.(type) {
+	case ErrorResponse:
+		if e.StatusCode != 0 {
+			return e.StatusCode
+		}
+		return http.StatusBadRequest
+	case ErrorResponseList:
+		return http.StatusBadRequest
+	case UnauthorizedError:
+		return http.StatusForbidden
+	case NotFoundError:
+		return http.StatusNotFound
+	case ConflictError, DuplicateError:
+		return http.StatusConflict
+	case InsufficientError, InvalidError, JSONUnmarshalError, MismatchError,
+		MissingError, TypeError, ValidityError:
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
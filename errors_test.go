@@ -1,6 +1,13 @@
 package gae
 
-import "testing"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"google.golang.org/appengine/datastore"
+)
 
 func runtest(t *testing.T, name, exp, act string) {
 	if exp != act {
@@ -76,6 +83,25 @@ func TestErrors2(t *testing.T) {
 	if !IsNotFoundError(eg4) {
 		t.Errorf("expect IsNotFoundError to return true; got false")
 	}
+	if eg4.Unwrap() != ee1 || !errors.Is(eg4, ee1) {
+		t.Errorf("expect NotFoundError to unwrap to '%v'", ee1)
+	}
+
+	ej1 := ConflictError{}
+	runtest(t, "ConflictError.Error - basic", "Conflict", ej1.Error())
+	ej2 := ConflictError{Msg: "generation mismatch", Err: ee1}
+	runtest(t, "ConflictError.Error - with msg and error", "Conflict (generation mismatch) - Missing value", ej2.Error())
+	if !IsConflictError(ej2) || !errors.Is(ej2, ee1) {
+		t.Errorf("expect IsConflictError to return true and unwrap to '%v'", ee1)
+	}
+
+	ek1 := UnauthorizedError{}
+	runtest(t, "UnauthorizedError.Error - basic", "Unauthorized", ek1.Error())
+	ek2 := UnauthorizedError{Msg: "role 'admin' is required"}
+	runtest(t, "UnauthorizedError.Error - with msg", "Unauthorized - role 'admin' is required", ek2.Error())
+	if !IsUnauthorizedError(ek2) {
+		t.Errorf("expect IsUnauthorizedError to return true; got false")
+	}
 
 	eh1 := ValidityError{}
 	runtest(t, "ValidityError.Error - basic", "validation error - ", eh1.Error())
@@ -97,3 +123,58 @@ func TestErrors2(t *testing.T) {
 		t.Error("expect IsTypeError to return true; got false")
 	}
 }
+
+func TestErrorsUnwrap(t *testing.T) {
+	wrapped := fmt.Errorf("loading ointment: %w", NotFoundError{
+		Kind: "Ointment",
+		Err:  datastore.ErrNoSuchEntity,
+	})
+	if !errors.Is(wrapped, datastore.ErrNoSuchEntity) {
+		t.Errorf("expect '%v' to be datastore.ErrNoSuchEntity", wrapped)
+	}
+	var nfe NotFoundError
+	if !errors.As(wrapped, &nfe) || nfe.Kind != "Ointment" {
+		t.Errorf("expect '%v' to be a NotFoundError of Ointment", wrapped)
+	}
+
+	ne := NilError{Msg: "key", Err: ErrNilKey}
+	if !errors.Is(ne, ErrNilKey) {
+		t.Errorf("expect '%v' to be ErrNilKey", ne)
+	}
+
+	var v interface{}
+	je := JSONUnmarshalError{Msg: "request body", Err: json.Unmarshal([]byte("{"), &v)}
+	var se *json.SyntaxError
+	if !errors.As(je, &se) {
+		t.Errorf("expect '%v' to be a *json.SyntaxError", je)
+	}
+
+	if errors.Is(NilError{Msg: "key"}, ErrNilKey) {
+		t.Error("expect NilError without an error to not be ErrNilKey")
+	}
+}
+
+func TestStatusForError(t *testing.T) {
+	cases := []struct {
+		e    error
+		want int
+	}{
+		{nil, 200},
+		{ErrUnauth, 401},
+		{NotFoundError{}, 404},
+		{DuplicateError{}, 409},
+		{ConflictError{}, 409},
+		{UnauthorizedError{}, 403},
+		{InvalidError{}, 400},
+		{ValidityError{}, 400},
+		{ErrorResponse{}, 400},
+		{ErrorResponse{StatusCode: 404}, 404},
+		{ErrorResponseList{{Field: "name"}}, 400},
+		{ErrNilKey, 500},
+	}
+	for _, c := range cases {
+		if got := StatusForError(c.e); c.want != got {
+			t.Errorf("expect status of '%v' to be %d; got %d", c.e, c.want, got)
+		}
+	}
+}
@@ -3,19 +3,31 @@ package gae
 
 import (
 	"bytes"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net/http"
+	"net/mail"
 	"net/url"
+	"reflect"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 const (
@@ -25,20 +37,67 @@ const (
 	// lower-case because it is following the specifications and App Engine
 	// changes it to all lowercase no matter the original casing.
 	HeaderError = "x-error"
+	// HeaderCron is the header set by App Engine on requests made by the Cron
+	// Service. App Engine removes it from requests made by external sources.
+	HeaderCron = "X-Appengine-Cron"
+	// HeaderQueueName is the header set by App Engine on requests made by the
+	// Task Queue. App Engine removes it from requests made by external
+	// sources.
+	HeaderQueueName = "X-Appengine-QueueName"
 	// KindCounterConfig is the entity kind for storing the sharded counter
 	// configuration.
 	KindCounterConfig = "GAECounterConfig"
 	// KindCounterShard is the entity kind for storing a shard of the counter.
 	KindCounterShard = "GAECounterShard"
+	// KindLock is the kind of entity stored in the Datastore for holding a
+	// distributed lock.
+	KindLock = "GAELock"
 	// KindSession is the kind of entity stored in the Datastore for
 	// maintaining session.
 	KindSession = "GAESession"
+	// The default number of results in a page if not specified.
+	defaultPageLimit = 50
 	// The default number of shards if not specified.
 	defaultShards = 5
 )
 
+var (
+	// ExposeInternalErrors controls whether the details of internal errors
+	// (e.g. the value of a recovered panic) are included in the message of
+	// the ErrorResponse sent to the client. It should only be enabled during
+	// development.
+	ExposeInternalErrors bool
+
+	// PageTokenSecret is the key for signing the tokens created by
+	// EncodePageToken and the cursors signed by SignCursor. It must be set
+	// before using the page tokens and should be the same across all
+	// instances of the application.
+	PageTokenSecret []byte
+
+	// SessionSigningKey, if set, is the key for signing the session IDs in
+	// the cookies created by MakeSessionCookie so that tampered IDs are
+	// rejected before the session is looked up. If it is not set, the
+	// session IDs are not signed. Changing the key invalidates all existing
+	// session cookies.
+	SessionSigningKey []byte
+
+	// TimedHook, if set, is called by Timed with the name and the duration
+	// of each operation after it is logged.
+	TimedHook func(name string, d time.Duration)
+)
+
 // INTERFACE definitions
 
+// CacheInvalidator specifies a method RelatedCacheKeys that returns the
+// memcache keys of other items that become stale when the entity changes.
+//
+// Data models whose changes affect cached related entities (e.g. a parent
+// whose children are cached together with it) should implement this method
+// so that SaveCacheEntity and DeleteEntity evict those items as well.
+type CacheInvalidator interface {
+	RelatedCacheKeys() []string
+}
+
 // Datastorer is an interface that all application models must implement
 // in order to be able to save to and load from the Datastore.
 //
@@ -59,6 +118,17 @@ type Datastorer interface {
 	ValidationError() []string
 }
 
+// PartialValidator specifies a method ValidationErrorFor that validates only
+// the specified fields.
+//
+// Data models that are populated in parts (e.g. multi-step forms) should
+// implement this method so that each part can be validated with
+// ValidatePartial. Like ValidationError, it returns a slice of string with
+// the fields that do not meet the validation rules.
+type PartialValidator interface {
+	ValidationErrorFor(fields []string) []string
+}
+
 // Presaver specifies a method Presave with no return values.
 //
 // Data models that require some "cleanup" before saving into the Datastore
@@ -82,9 +152,57 @@ type counterShard struct {
 	Count int `datastore:",noindex"`
 }
 
+// counterAdd adds delta to the value of a randomly selected shard of the
+// named counter, creating the counter configuration if it does not exist.
+func counterAdd(ctx context.Context, name string, delta int) error {
+	var cfg counterConfig
+	ckey := datastore.NewKey(ctx, KindCounterConfig, name, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		err := datastore.Get(ctx, ckey, &cfg)
+		if err == datastore.ErrNoSuchEntity {
+			cfg.Shards = defaultShards
+			_, err = datastore.Put(ctx, ckey, &cfg)
+		}
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+	var s counterShard
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		shardName := fmt.Sprintf("%v-shard%d", name, rand.Intn(cfg.Shards))
+		key := datastore.NewKey(ctx, KindCounterShard, shardName, 0, nil)
+		err := datastore.Get(ctx, key, &s)
+		if err != nil && err != datastore.ErrNoSuchEntity { //fine if not found
+			return err
+		}
+		s.Name = name
+		s.Count += delta
+		_, err = datastore.Put(ctx, key, &s)
+		return err
+	}, nil)
+}
+
+// counterAllShardKeys creates the keys of all the possible shards of the named
+// counter with the specified number of shards.
+func counterAllShardKeys(ctx context.Context, name string, shards int) []*datastore.Key {
+	keys := make([]*datastore.Key, shards)
+	for i := range keys {
+		shardName := fmt.Sprintf("%v-shard%d", name, i)
+		keys[i] = datastore.NewKey(ctx, KindCounterShard, shardName, 0, nil)
+	}
+	return keys
+}
+
 // counterMemcacheKey creates the key for the memcache object storing the
 // counter by prefixing the name with the constant `KindCounterShard` and ":".
-func counterMemcacheKey(name string) string {
+//
+// If the context has a namespace, it is included between the prefix and the
+// name, e.g. "GAECounterShard:tenant1:signups".
+func counterMemcacheKey(ctx context.Context, name string) string {
+	if ns := datastore.NewKey(ctx, KindCounterShard, name, 0, nil).Namespace(); ns != "" {
+		return KindCounterShard + ":" + ns + ":" + name
+	}
 	return KindCounterShard + ":" + name
 }
 
@@ -95,10 +213,19 @@ func counterMemcacheKey(name string) string {
 // Datastore.
 func CounterCount(ctx context.Context, name string) (int, error) {
 	total := 0
-	mkey := counterMemcacheKey(name)
-	if _, err := memcache.JSON.Get(ctx, mkey, &total); err == nil {
+	if _, err := memcache.JSON.Get(ctx, counterMemcacheKey(ctx, name), &total); err == nil {
 		return total, nil
 	}
+	return CounterCountFresh(ctx, name)
+}
+
+// CounterCountFresh gets the value of the counter by summing up the values of
+// all the sharded counters in the Datastore, ignoring any value in memcache.
+// This is for reconciliation when the cached value may be stale.
+//
+// The counter in memcache is updated with the computed value.
+func CounterCountFresh(ctx context.Context, name string) (int, error) {
+	total := 0
 	q := datastore.NewQuery(KindCounterShard).Filter("Name =", name)
 	for it := q.Run(ctx); ; {
 		var s counterShard
@@ -112,49 +239,114 @@ func CounterCount(ctx context.Context, name string) (int, error) {
 		total += s.Count
 	}
 	memcache.JSON.Set(ctx, &memcache.Item{
-		Key:        mkey,
+		Key:        counterMemcacheKey(ctx, name),
 		Object:     &total,
 		Expiration: 60,
 	})
 	return total, nil
 }
 
-// CounterIncrement increments the named counter.
+// CounterCountNS gets the value of the named counter in the namespace, like
+// CounterCount. This is for keeping separate counters for each tenant of a
+// multi-tenant application.
 //
-// This function increases by 1 the value of a randomly selected shard, and
+// The other counter functions can be used with namespaced counters by
+// passing them a context from `appengine.Namespace`.
+func CounterCountNS(ctx context.Context, namespace, name string) (int, error) {
+	nsCtx, err := appengine.Namespace(ctx, namespace)
+	if err != nil {
+		return 0, err
+	}
+	return CounterCount(nsCtx, name)
+}
+
+// CounterDecrement decrements the named counter.
+//
+// This function decreases by 1 the value of a randomly selected shard, and
 // also that of the counter in memcache.
-func CounterIncrement(ctx context.Context, name string) error {
+//
+// There is no lower bound on the counter, i.e. the total goes below zero if
+// it is decremented more times than it is incremented.
+func CounterDecrement(ctx context.Context, name string) error {
+	return CounterIncrementBy(ctx, name, -1)
+}
+
+// CounterDelete removes the named counter entirely, i.e. all its shards and
+// its configuration, and clears the counter in memcache.
+//
+// The name can then be reused for a new counter, which starts with the
+// default number of shards.
+func CounterDelete(ctx context.Context, name string) error {
 	var cfg counterConfig
 	ckey := datastore.NewKey(ctx, KindCounterConfig, name, 0, nil)
-	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		err := datastore.Get(ctx, ckey, &cfg)
-		if err == datastore.ErrNoSuchEntity {
-			cfg.Shards = defaultShards
-			_, err = datastore.Put(ctx, ckey, &cfg)
-		}
-		return err
-	}, nil)
-	if err != nil {
+	err := datastore.Get(ctx, ckey, &cfg)
+	if err != nil && err != datastore.ErrNoSuchEntity {
 		return err
 	}
-	var s counterShard
-	err = datastore.RunInTransaction(ctx, func(ctx context.Context) error {
-		shardName := fmt.Sprintf("%v-shard%d", name, rand.Intn(cfg.Shards))
-		key := datastore.NewKey(ctx, KindCounterShard, shardName, 0, nil)
-		err := datastore.Get(ctx, key, &s)
-		if err != nil && err != datastore.ErrNoSuchEntity { //fine if not found
-			return err
-		}
-		s.Name = name
-		s.Count++
-		_, err = datastore.Put(ctx, key, &s)
+	keys := append(counterAllShardKeys(ctx, name, cfg.Shards), ckey)
+	if e := datastore.DeleteMulti(ctx, keys); e != nil {
+		return e
+	}
+	memcache.Delete(ctx, counterMemcacheKey(ctx, name)) //ignore cache miss error
+	return nil
+}
+
+// CounterIncrement increments the named counter.
+//
+// This function increases by 1 the value of a randomly selected shard, and
+// also that of the counter in memcache.
+func CounterIncrement(ctx context.Context, name string) error {
+	return CounterIncrementBy(ctx, name, 1)
+}
+
+// CounterIncrementBy adds delta to the named counter.
+//
+// This function adds delta to the value of a randomly selected shard, and
+// also to that of the counter in memcache. A negative delta decrements the
+// counter, and the total can go below zero.
+//
+// Because memcache does not hold negative values, the cached counter is
+// cleared when it is decremented to zero (or cannot be updated) so that the
+// next CounterCount reads the total from the Datastore.
+func CounterIncrementBy(ctx context.Context, name string, delta int) error {
+	if err := counterAdd(ctx, name, delta); err != nil {
 		return err
-	}, nil)
+	}
+	mkey := counterMemcacheKey(ctx, name)
+	v, err := memcache.IncrementExisting(ctx, mkey, int64(delta))
+	if (err == nil && delta < 0 && v == 0) || (err != nil && err != memcache.ErrCacheMiss) {
+		memcache.Delete(ctx, mkey) //ignore any error
+	}
+	return nil
+}
+
+// CounterIncrementN increments the named counter like CounterIncrement, and
+// returns the new total.
+//
+// The total is the incremented value of the counter in memcache if it is
+// cached, otherwise it is summed from the shards (as in CounterCountFresh).
+// This is a best-effort value that may lag behind the actual total, because
+// of concurrent increments and the eventual consistency of the query over the
+// shards.
+func CounterIncrementN(ctx context.Context, name string) (int, error) {
+	if err := counterAdd(ctx, name, 1); err != nil {
+		return 0, err
+	}
+	v, err := memcache.IncrementExisting(ctx, counterMemcacheKey(ctx, name), 1)
+	if err == nil {
+		return int(v), nil
+	}
+	return CounterCountFresh(ctx, name)
+}
+
+// CounterIncrementNS increments the named counter in the namespace, like
+// CounterIncrement.
+func CounterIncrementNS(ctx context.Context, namespace, name string) error {
+	nsCtx, err := appengine.Namespace(ctx, namespace)
 	if err != nil {
 		return err
 	}
-	memcache.IncrementExisting(ctx, counterMemcacheKey(name), 1) //ignore cache miss error
-	return nil
+	return CounterIncrement(nsCtx, name)
 }
 
 // CounterIncreaseShards increases the number of shards for the named counter.
@@ -187,8 +379,166 @@ func CounterIncreaseShards(ctx context.Context, name string, n int) error {
 	}, nil)
 }
 
+// CounterInit creates the named counter with the specified number of shards,
+// which should be higher than the default for counters that are incremented
+// frequently. Subsequent increments are spread across that many shards.
+//
+// This is a no-op if the counter already exists, i.e. it cannot change the
+// number of shards of an existing counter. Use CounterIncreaseShards for
+// that, which likewise cannot lower the number of shards.
+func CounterInit(ctx context.Context, name string, shards int) error {
+	if shards <= 0 {
+		return InvalidError{
+			Msg: fmt.Sprintf("number of shards must be positive; got %d", shards),
+		}
+	}
+	ckey := datastore.NewKey(ctx, KindCounterConfig, name, 0, nil)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var cfg counterConfig
+		err := datastore.Get(ctx, ckey, &cfg)
+		if err != datastore.ErrNoSuchEntity {
+			return err //nil if it already exists
+		}
+		cfg.Shards = shards
+		_, err = datastore.Put(ctx, ckey, &cfg)
+		return err
+	}, nil)
+}
+
+// CounterReset resets the named counter to zero by deleting all its shards,
+// and clears the counter in memcache. The configuration of the counter (i.e.
+// the number of shards) is left intact.
+//
+// The keys of the shards are derived from the configuration instead of being
+// queried so that shards that were recently written are not missed.
+func CounterReset(ctx context.Context, name string) error {
+	var cfg counterConfig
+	ckey := datastore.NewKey(ctx, KindCounterConfig, name, 0, nil)
+	err := datastore.Get(ctx, ckey, &cfg)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	if e := datastore.DeleteMulti(ctx, counterAllShardKeys(ctx, name, cfg.Shards)); e != nil {
+		return e
+	}
+	memcache.Delete(ctx, counterMemcacheKey(ctx, name)) //ignore cache miss error
+	return nil
+}
+
+// CounterShardKeys gets the keys of all the shards of the named counter.
+//
+// This is meant for inspecting the raw shard entities when debugging. Only
+// the shards that have been incremented at least once exist.
+func CounterShardKeys(ctx context.Context, name string) ([]*datastore.Key, error) {
+	q := datastore.NewQuery(KindCounterShard).Filter("Name =", name).KeysOnly()
+	return q.GetAll(ctx, nil)
+}
+
+// ListCounters gets the names of all the counters, in alphabetical order.
+//
+// Counters are listed once they have been incremented (or their shards
+// increased) at least once, since that is when their configuration is
+// created.
+func ListCounters(ctx context.Context) ([]string, error) {
+	q := datastore.NewQuery(KindCounterConfig).KeysOnly()
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.StringID()
+	}
+	return names, nil
+}
+
+// Date definitions
+
+// DateLayout is the layout of Date in JSON and as a string.
+const DateLayout = "2006-01-02"
+
+// Date is an auxillary struct for time.Time specifically for the purpose of
+// representing a calendar date (e.g. a birthday) in the format "YYYY-MM-DD"
+// in JSON.
+//
+// The time of day and timezone are not meaningful for Date. Instances should
+// be created with NewDate, which sets the time to midnight in UTC, as the day
+// is always read in UTC. This keeps the date intact regardless of the
+// location that the time is in after it is loaded from the Datastore.
+type Date struct {
+	time.Time
+}
+
+// Equal checks whether the two dates are on the same day, i.e. they have the
+// same year, month and day in UTC, ignoring the time of day.
+func (d1 *Date) Equal(d2 Date) bool {
+	y1, m1, dd1 := d1.UTC().Date()
+	y2, m2, dd2 := d2.UTC().Date()
+	return y1 == y2 && m1 == m2 && dd1 == dd2
+}
+
+// MarshalJSON converts the date into a format like
+//
+//	"2006-01-02"
+//
+// or an empty string if `time.Time.IsZero()`
+func (d *Date) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return json.Marshal("")
+	}
+	return json.Marshal(d.String())
+}
+
+// String for Date returns the date in UTC in the format "YYYY-MM-DD".
+func (d *Date) String() string {
+	return d.UTC().Format(DateLayout)
+}
+
+// UnmarshalJSON expects the input to a string like
+//
+//	"2006-01-02"
+//
+// to convert into a time.Time struct wrapped inside Date. It is able to
+// understand an empty string ("") and convert it to a zeroed `time.Time`
+// instance.
+func (d *Date) UnmarshalJSON(input []byte) error {
+	if bytes.Equal([]byte(`""`), input) { //i.e. ""
+		*d = Date{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		return err
+	}
+	dt, err := NewDate(s)
+	if err != nil {
+		return err
+	}
+	*d = dt
+	return nil
+}
+
+// NewDate creates a new Date instance from a string. The parameter `date` is
+// a string in the format "YYYY-MM-DD". The time is set to midnight in UTC.
+func NewDate(date string) (Date, error) {
+	t, err := time.Parse(DateLayout, date)
+	if err != nil {
+		return Date{}, err
+	}
+	return Date{t}, nil
+}
+
 // DateTime definitions
 
+// DateTimeLayout is the layout of DateTime in JSON, text and as a string.
+const DateTimeLayout = time.RFC3339
+
+// ZeroDateTime is the zero value of DateTime, i.e. a time that is not set.
+// This is for building queries on unset times, e.g.
+//
+//	q.Filter("Expiry =", ZeroDateTime.Time)
+var ZeroDateTime = DateTime{}
+
 // DateTime is an auxillary struct for time.Time specifically for the purpose
 // of converting to RFC3339 time format in JSON.
 //
@@ -197,13 +547,87 @@ type DateTime struct {
 	time.Time
 }
 
+// AddDate returns the time corresponding to adding the given number of
+// years, months and days to d. This is the same as `time.Time.AddDate`
+// except that the result is a DateTime.
+func (d DateTime) AddDate(years, months, days int) DateTime {
+	return DateTime{d.Time.AddDate(years, months, days)}
+}
+
+// AddDuration returns the time d+dur. This is the same as `time.Time.Add`
+// except that the result is a DateTime.
+func (d DateTime) AddDuration(dur time.Duration) DateTime {
+	return DateTime{d.Add(dur)}
+}
+
+// After checks whether the time is after that of d2, taking into account
+// timezone differences while ignoring sub-second differences.
+//
+// Unlike `time.Time.After`, this accepts a DateTime so that the time does not
+// need to be unwrapped. Use `d1.Time.After` to compare with a time.Time.
+func (d1 DateTime) After(d2 DateTime) bool {
+	return d1.Truncate(time.Second).After(d2.Truncate(time.Second))
+}
+
+// Before checks whether the time is before that of d2, taking into account
+// timezone differences while ignoring sub-second differences.
+//
+// Unlike `time.Time.Before`, this accepts a DateTime so that the time does
+// not need to be unwrapped. Use `d1.Time.Before` to compare with a
+// time.Time.
+func (d1 DateTime) Before(d2 DateTime) bool {
+	return d1.Truncate(time.Second).Before(d2.Truncate(time.Second))
+}
+
 // Equal checks whether the two timestamps are referring to the same moment,
 // taking into account timezone differences while ignoring sub-second
 // differences.
+//
+// A nil receiver is treated as a zeroed DateTime, i.e. it is equal to d2 only
+// if d2 is zeroed.
 func (d1 *DateTime) Equal(d2 DateTime) bool {
+	if d1 == nil {
+		return d2.IsZero()
+	}
 	return d1.Truncate(time.Second).Equal(d2.Truncate(time.Second))
 }
 
+// EqualWallClock checks whether the two timestamps have the same wall clock
+// time and UTC offset, ignoring sub-second differences. Unlike Equal, two
+// timestamps referring to the same moment in different timezones are not
+// equal, e.g. for calendar appointments where the timezone matters.
+//
+// The timestamps are compared in the format of DateTimeLayout, so different
+// locations with the same offset are still equal.
+func (d DateTime) EqualWallClock(d2 DateTime) bool {
+	return d.Format(DateTimeLayout) == d2.Format(DateTimeLayout)
+}
+
+// GobDecode expects the input to be produced by GobEncode, i.e. a time in
+// the format "2006-01-02T15:04:05+07:00" or empty for a zeroed time.
+func (d *DateTime) GobDecode(input []byte) error {
+	return d.UnmarshalText(input)
+}
+
+// GobEncode converts the time into the same format as MarshalText so that
+// structs holding a DateTime can be cached with `encoding/gob`. Sub-second
+// values are dropped and a zeroed time is encoded as empty.
+func (d DateTime) GobEncode() ([]byte, error) {
+	return d.MarshalText()
+}
+
+// ISOWeek returns the ISO 8601 year and week number of the time. This is the
+// same as `time.Time.ISOWeek`.
+func (d DateTime) ISOWeek() (year, week int) {
+	return d.Time.ISOWeek()
+}
+
+// IsSet checks whether the time is set, i.e. it is the inverse of
+// `time.Time.IsZero`.
+func (d DateTime) IsSet() bool {
+	return !d.IsZero()
+}
+
 // MarshalJSON converts the time into a format like
 //
 //  "2006-01-02T15:04:05+07:00"
@@ -213,7 +637,36 @@ func (d *DateTime) MarshalJSON() ([]byte, error) {
 	if d.IsZero() {
 		return json.Marshal("")
 	}
-	return json.Marshal(d.Format(time.RFC3339))
+	return json.Marshal(d.Format(DateTimeLayout))
+}
+
+// MarshalText converts the time into a format like
+//
+//	2006-01-02T15:04:05+07:00
+//
+// or an empty string if `time.Time.IsZero()`. This is the same as MarshalJSON
+// less the quotes, and allows DateTime to be used as a key of maps that are
+// converted to JSON.
+func (d DateTime) MarshalText() ([]byte, error) {
+	if d.IsZero() {
+		return []byte{}, nil
+	}
+	return []byte(d.Format(DateTimeLayout)), nil
+}
+
+// StartOfWeek returns midnight of the Monday of the week that the time falls
+// in, according to the location `loc`. If `loc` is nil, the location of the
+// time is used.
+//
+// Note that the day of the week depends on the location, e.g. Sunday evening
+// in UTC is already Monday in Asia.
+func (d DateTime) StartOfWeek(loc *time.Location) DateTime {
+	if loc == nil {
+		loc = d.Location()
+	}
+	t := d.In(loc)
+	offset := (int(t.Weekday()) + 6) % 7 //days since Monday
+	return DateTime{time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, loc)}
 }
 
 // String for DateTime returns the time in this format
@@ -221,9 +674,59 @@ func (d *DateTime) MarshalJSON() ([]byte, error) {
 //
 //	e.g. 2006-01-02T15:04:05+07:00
 //
-// In other words, the output is formatted using `time.RFC3339`
+// In other words, the output is formatted using DateTimeLayout
 func (d *DateTime) String() string {
-	return d.Format(time.RFC3339)
+	return d.Format(DateTimeLayout)
+}
+
+// ToProtoTimestamp converts the time into a Protocol Buffers
+// `google.protobuf.Timestamp`.
+//
+// A zeroed DateTime is converted to nil, which is the conventional
+// representation of an unset timestamp.
+func (d DateTime) ToProtoTimestamp() *timestamppb.Timestamp {
+	if d.IsZero() {
+		return nil
+	}
+	return timestamppb.New(d.Time)
+}
+
+// UTC returns the time with the location set to UTC. This is the same as
+// `time.Time.UTC` except that the result is a DateTime.
+func (d DateTime) UTC() DateTime {
+	return DateTime{d.Time.UTC()}
+}
+
+// Unix returns the time as the number of seconds elapsed since January 1,
+// 1970 UTC. This is the same as `time.Time.Unix`.
+//
+// This is useful for kinds that need a compact indexed property for range
+// filters. Store the value in an int64 field alongside the DateTime, e.g. in
+// Presave:
+//
+//	type Event struct {
+//		Start     DateTime `datastore:",noindex"`
+//		StartUnix int64
+//	}
+//
+//	func (e *Event) Presave() {
+//		e.StartUnix = e.Start.Unix()
+//	}
+//
+// and filter on it with a query like
+//
+//	q.Filter("StartUnix >=", from.Unix())
+//
+// DateTimeFromUnix converts the value back to a DateTime.
+func (d DateTime) Unix() int64 {
+	return d.Time.Unix()
+}
+
+// UnixSeconds returns the time as the number of seconds elapsed since
+// January 1, 1970 UTC. This is the counterpart of unmarshalling a JSON number
+// with UnmarshalJSON.
+func (d DateTime) UnixSeconds() int64 {
+	return d.Unix()
 }
 
 // UnmarshalJSON expects the input to a string like
@@ -233,16 +736,27 @@ func (d *DateTime) String() string {
 // to convert into a time.Time struct wrapped inside DateTime. It is able to
 // understand an empty string ("") and convert it to a zeroed `time.Time`
 // instance.
+//
+// A bare JSON number (e.g. 1136214245) is interpreted as the number of seconds
+// since the Unix epoch, and the resulting time is in UTC.
 func (d *DateTime) UnmarshalJSON(input []byte) error {
 	if bytes.Equal([]byte(`""`), input) { //i.e. ""
-		d = &DateTime{}
+		*d = DateTime{}
+		return nil
+	}
+	if len(input) > 0 && (input[0] == '-' || (input[0] >= '0' && input[0] <= '9')) {
+		var secs int64
+		if err := json.Unmarshal(input, &secs); err != nil {
+			return err
+		}
+		*d = DateTimeFromUnix(secs)
 		return nil
 	}
 	var s string
 	if err := json.Unmarshal(input, &s); err != nil {
 		return err
 	}
-	t, err := time.Parse(time.RFC3339, s)
+	t, err := time.Parse(DateTimeLayout, s)
 	if err != nil {
 		return err
 	}
@@ -250,25 +764,257 @@ func (d *DateTime) UnmarshalJSON(input []byte) error {
 	return nil
 }
 
-// NewDateTime creates a new DateTime instance from a string. The parameter
-// `tstamp` is a string in the format "YYYY-MM-DDTHH:mm:ss+HH:mm"
-func NewDateTime(tstamp string) (DateTime, error) {
-	t, err := time.Parse(time.RFC3339, tstamp)
+// UnmarshalText expects the input to be a string like
+//
+//	2006-01-02T15:04:05+07:00
+//
+// to convert into a time.Time struct wrapped inside DateTime. An empty string
+// is converted to a zeroed `time.Time` instance. This is the same as
+// UnmarshalJSON less the quotes.
+func (d *DateTime) UnmarshalText(input []byte) error {
+	if len(input) == 0 {
+		*d = DateTime{}
+		return nil
+	}
+	t, err := time.Parse(DateTimeLayout, string(input))
 	if err != nil {
-		return DateTime{}, err
-	} else {
-		return DateTime{t}, nil
+		return err
 	}
+	d.Time = t
+	return nil
 }
 
-// NewDateTimeNow creates a new DateTime instance representing the moment in
-// time the function was called. This is basically shorthand for:
+// CombineDateTime creates a new DateTime instance from separate date and time
+// parts, e.g. from a form that posts "date=2024-07-03" and "time=14:30".
 //
-//	DateTime{time.Now()}
-func NewDateTimeNow() DateTime {
-	return DateTime{time.Now()}
-}
-
+// The date is in the format "YYYY-MM-DD" and the time is in the format
+// "HH:mm" or "HH:mm:ss". The result is in the location `loc`, or UTC if it is
+// nil.
+//
+// An InvalidError is returned if either part is malformed.
+func CombineDateTime(date, timeStr string, loc *time.Location) (DateTime, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	d, err := time.ParseInLocation(DateLayout, date, loc)
+	if err != nil {
+		return DateTime{}, InvalidError{
+			Msg: fmt.Sprintf("date '%v' is not in the format YYYY-MM-DD", date),
+		}
+	}
+	t, err := time.Parse("15:04:05", timeStr)
+	if err != nil {
+		t, err = time.Parse("15:04", timeStr)
+	}
+	if err != nil {
+		return DateTime{}, InvalidError{
+			Msg: fmt.Sprintf("time '%v' is not in the format HH:mm or HH:mm:ss", timeStr),
+		}
+	}
+	return DateTime{time.Date(d.Year(), d.Month(), d.Day(),
+		t.Hour(), t.Minute(), t.Second(), 0, loc)}, nil
+}
+
+// DateTimeFromProto creates a new DateTime instance from a Protocol Buffers
+// `google.protobuf.Timestamp`. The time is in UTC.
+//
+// A nil timestamp is converted to a zeroed DateTime.
+func DateTimeFromProto(ts *timestamppb.Timestamp) DateTime {
+	if ts == nil {
+		return DateTime{}
+	}
+	return DateTime{ts.AsTime()}
+}
+
+// DateTimeFromUnix creates a new DateTime instance from the number of seconds
+// elapsed since January 1, 1970 UTC. The time is in UTC.
+func DateTimeFromUnix(secs int64) DateTime {
+	return DateTime{time.Unix(secs, 0).UTC()}
+}
+
+// NewDateTime creates a new DateTime instance from a string. The parameter
+// `tstamp` is a string in the format "YYYY-MM-DDTHH:mm:ss+HH:mm"
+func NewDateTime(tstamp string) (DateTime, error) {
+	t, err := time.Parse(DateTimeLayout, tstamp)
+	if err != nil {
+		return DateTime{}, err
+	} else {
+		return DateTime{t}, nil
+	}
+}
+
+// NewDateTimeFrom creates a new DateTime instance from a string by attempting
+// to parse it with each of the layouts in turn, returning the first success.
+// This is for timestamps from sources that vary in format, e.g.
+//
+//	NewDateTimeFrom(tstamp, time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05Z07:00")
+//
+// If no layouts are specified, DateTimeLayout is used (i.e. the same as
+// NewDateTime). Timestamps parsed with layouts without a timezone are in
+// UTC.
+//
+// An InvalidError listing the attempted layouts is returned if none of them
+// match.
+func NewDateTimeFrom(tstamp string, layouts ...string) (DateTime, error) {
+	if len(layouts) == 0 {
+		layouts = []string{DateTimeLayout}
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, tstamp); err == nil {
+			return DateTime{t}, nil
+		}
+	}
+	return DateTime{}, InvalidError{
+		Msg: fmt.Sprintf("'%v' does not match any of the layouts %q", tstamp, layouts),
+	}
+}
+
+// NewDateTimeNow creates a new DateTime instance representing the moment in
+// time the function was called. This is basically shorthand for:
+//
+//	DateTime{time.Now()}
+func NewDateTimeNow() DateTime {
+	return DateTime{time.Now()}
+}
+
+// ParseDateTime creates a new DateTime instance from a string in the
+// specified layout. This is for one-off timestamps that are not in
+// DateTimeLayout, e.g.
+//
+//	ParseDateTime("02 Jan 2006 15:04", "31 Jan 2016 13:22")
+func ParseDateTime(layout, value string) (DateTime, error) {
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return DateTime{}, err
+	}
+	return DateTime{t}, nil
+}
+
+// DateTimeMillis is a variant of DateTime that keeps the time up to the
+// milliseconds instead of the seconds.
+//
+// It is for timestamps whose sub-second values must survive being converted
+// to JSON and stored in the Datastore, e.g. the time of an event.
+type DateTimeMillis struct {
+	time.Time
+}
+
+// Equal checks whether the two timestamps are referring to the same moment,
+// taking into account timezone differences while ignoring sub-millisecond
+// differences.
+func (d1 *DateTimeMillis) Equal(d2 DateTimeMillis) bool {
+	return d1.Truncate(time.Millisecond).Equal(d2.Truncate(time.Millisecond))
+}
+
+// MarshalJSON converts the time into a format like
+//
+//	"2006-01-02T15:04:05.999+07:00"
+//
+// or an empty string if `time.Time.IsZero()`. Trailing zeros of the
+// milliseconds are removed.
+func (d *DateTimeMillis) MarshalJSON() ([]byte, error) {
+	if d.IsZero() {
+		return json.Marshal("")
+	}
+	return json.Marshal(d.String())
+}
+
+// String for DateTimeMillis returns the time in this format
+// "YYYY-MM-DDTHH:mm:ss.sss+HH:mm"
+//
+//	e.g. 2006-01-02T15:04:05.999+07:00
+//
+// In other words, the output is formatted using `time.RFC3339Nano` after
+// truncating the time to the milliseconds.
+func (d *DateTimeMillis) String() string {
+	return d.Truncate(time.Millisecond).Format(time.RFC3339Nano)
+}
+
+// UnmarshalJSON expects the input to a string like
+//
+//	"2006-01-02T15:04:05.999+07:00"
+//
+// to convert into a time.Time struct wrapped inside DateTimeMillis. The
+// fractional seconds are optional. It is able to understand an empty string
+// ("") and convert it to a zeroed `time.Time` instance.
+func (d *DateTimeMillis) UnmarshalJSON(input []byte) error {
+	if bytes.Equal([]byte(`""`), input) { //i.e. ""
+		*d = DateTimeMillis{}
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(input, &s); err != nil {
+		return err
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return err
+	}
+	d.Time = t.Truncate(time.Millisecond)
+	return nil
+}
+
+// DateTimeRange is a period of time between two instances of DateTime.
+//
+// A zeroed Start or End means that the range is unbounded on that side.
+type DateTimeRange struct {
+	Start DateTime `json:"start"`
+	End   DateTime `json:"end"`
+}
+
+// Contains checks whether d falls within the range, inclusive of both ends.
+// Sub-second differences are ignored.
+func (r *DateTimeRange) Contains(d DateTime) bool {
+	if !r.Start.IsZero() && d.Before(r.Start) {
+		return false
+	}
+	if !r.End.IsZero() && d.After(r.End) {
+		return false
+	}
+	return true
+}
+
+// MarshalJSON converts the range into an object like
+//
+//	{"start":"2006-01-02T15:04:05+07:00","end":""}
+//
+// where each of the times follows the rules of DateTime.MarshalJSON. This
+// has a value receiver so that the rules apply even if the range is not
+// addressable.
+func (r DateTimeRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start *DateTime `json:"start"`
+		End   *DateTime `json:"end"`
+	}{&r.Start, &r.End})
+}
+
+// Overlaps checks whether the range shares at least a moment with r2. Ranges
+// that merely touch (i.e. one ends when the other starts) are considered to
+// overlap.
+//
+// An invalid range does not overlap with any other range.
+func (r *DateTimeRange) Overlaps(r2 DateTimeRange) bool {
+	if !r.Valid() || !r2.Valid() {
+		return false
+	}
+	if !r.Start.IsZero() && !r2.End.IsZero() && r2.End.Before(r.Start) {
+		return false
+	}
+	if !r2.Start.IsZero() && !r.End.IsZero() && r.End.Before(r2.Start) {
+		return false
+	}
+	return true
+}
+
+// Valid checks that the start of the range is not after its end. A range
+// that is unbounded on either side is always valid.
+func (r *DateTimeRange) Valid() bool {
+	if r.Start.IsZero() || r.End.IsZero() {
+		return true
+	}
+	return !r.Start.After(r.End)
+}
+
 // ErrorResponse definitions
 
 // ErrorResponse should be the return payload if the API endpoints return an
@@ -277,6 +1023,9 @@ func NewDateTimeNow() DateTime {
 // All of the fields are optional. If not set, the fields are omitted from the
 // JSON output.
 type ErrorResponse struct {
+	// Details contains machine-readable context of the error, e.g.
+	// {"minLength": 8} for a value that is too short.
+	Details map[string]interface{} `json:"details,omitempty"`
 	// ErrorCode is a code that identifies the error. E.g. BAD_FORMAT
 	ErrorCode string `json:"errorCode,omitempty"`
 	// Field is the name of the field that has the error.
@@ -292,11 +1041,20 @@ type ErrorResponse struct {
 	Message string `json:"message,omitempty"`
 	// OriginalValue contains the original value from the request.
 	OriginalValue string `json:"originalValue,omitempty"`
+	// StatusCode is the HTTP status code of the response written by
+	// WriteError. It is not part of the JSON output.
+	StatusCode int `json:"-"`
 }
 
 // Equal checks if two instances of ErrorResponse are equal. They are
 // considered equal if and only if all fields are identical (case-sensitive).
+// The Details are compared deeply, with a nil map being different from an
+// empty one. The StatusCode is not compared as it is not part of the
+// payload.
 func (er ErrorResponse) Equal(e ErrorResponse) bool {
+	if !reflect.DeepEqual(er.Details, e.Details) {
+		return false
+	}
 	if er.ErrorCode != e.ErrorCode {
 		return false
 	}
@@ -321,7 +1079,7 @@ func (er ErrorResponse) Equal(e ErrorResponse) bool {
 //
 // If the "ErrorCode" is empty, the parentheses around it will not be included.
 //
-// The same applies for "OriginalValue".
+// The same applies for "OriginalValue". The "Details" are not included.
 func (er ErrorResponse) Error() string {
 	var buf bytes.Buffer
 	if er.Message != "" {
@@ -349,6 +1107,266 @@ func (er ErrorResponse) Error() string {
 	return buf.String()
 }
 
+// ErrorResponseList holds multiple instances of ErrorResponse so that all of
+// the errors (e.g. of each field in a form) can be returned in a single
+// response. It is marshalled as a JSON array.
+type ErrorResponseList []ErrorResponse
+
+// Error returns the Error of each ErrorResponse in the list, separated by
+// "; ".
+func (ers ErrorResponseList) Error() string {
+	msgs := make([]string, len(ers))
+	for i, er := range ers {
+		msgs[i] = er.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ErrorResponseBuilder builds an ErrorResponse with chained calls, e.g.
+//
+//	er := NewErrorResponse().Code("BAD_FORMAT").Field("email").
+//		Msg("invalid email").Original(email).Build()
+type ErrorResponseBuilder struct {
+	er ErrorResponse
+}
+
+// Build returns the ErrorResponse that has been built.
+func (b *ErrorResponseBuilder) Build() ErrorResponse {
+	return b.er
+}
+
+// Code sets the ErrorCode of the ErrorResponse.
+func (b *ErrorResponseBuilder) Code(code string) *ErrorResponseBuilder {
+	b.er.ErrorCode = code
+	return b
+}
+
+// Field sets the Field of the ErrorResponse.
+func (b *ErrorResponseBuilder) Field(field string) *ErrorResponseBuilder {
+	b.er.Field = field
+	return b
+}
+
+// Help sets the HelpURL of the ErrorResponse.
+func (b *ErrorResponseBuilder) Help(helpURL string) *ErrorResponseBuilder {
+	b.er.HelpURL = helpURL
+	return b
+}
+
+// Msg sets the Message of the ErrorResponse.
+func (b *ErrorResponseBuilder) Msg(msg string) *ErrorResponseBuilder {
+	b.er.Message = msg
+	return b
+}
+
+// Original sets the OriginalValue of the ErrorResponse.
+func (b *ErrorResponseBuilder) Original(v string) *ErrorResponseBuilder {
+	b.er.OriginalValue = v
+	return b
+}
+
+// NewErrorResponse creates an ErrorResponseBuilder for building an
+// ErrorResponse.
+func NewErrorResponse() *ErrorResponseBuilder {
+	return &ErrorResponseBuilder{}
+}
+
+// ParseErrorResponse parses a payload that is either a single ErrorResponse
+// object or an array of them, e.g. on the client side of the API. A single
+// object is returned as a one-element slice. Unknown fields are ignored.
+//
+// A JSONUnmarshalError is returned if the payload is neither of the shapes.
+func ParseErrorResponse(body []byte) ([]ErrorResponse, error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var ers []ErrorResponse
+		if e := json.Unmarshal(trimmed, &ers); e != nil {
+			return nil, JSONUnmarshalError{
+				Msg: "ParseErrorResponse - array",
+				Err: e,
+			}
+		}
+		return ers, nil
+	}
+	var er ErrorResponse
+	if e := json.Unmarshal(trimmed, &er); e != nil {
+		return nil, JSONUnmarshalError{
+			Msg: "ParseErrorResponse - object",
+			Err: e,
+		}
+	}
+	return []ErrorResponse{er}, nil
+}
+
+// RequireJSONFields checks that the JSON object in body has all of the
+// top-level fields, so that a payload can be rejected before it is bound to a
+// model. One ErrorResponse with the error code MISSING is returned for each
+// missing field, in the order the fields are given. A field that is present
+// with a null value is not considered missing.
+//
+// If the body is not a JSON object, a single ErrorResponse with the error
+// code BAD_FORMAT is returned.
+func RequireJSONFields(body []byte, fields ...string) []ErrorResponse {
+	var m map[string]json.RawMessage
+	if e := json.Unmarshal(body, &m); e != nil || m == nil {
+		return []ErrorResponse{{
+			ErrorCode: "BAD_FORMAT",
+			Message:   "request body is not a JSON object",
+		}}
+	}
+	var ers []ErrorResponse
+	for _, f := range fields {
+		if _, ok := m[f]; !ok {
+			ers = append(ers, ErrorResponse{
+				ErrorCode: "MISSING",
+				Field:     f,
+				Message:   f + " is required",
+			})
+		}
+	}
+	return ers
+}
+
+// entitySorter sorts a slice of Datastorer together with the values of the
+// field that they are sorted by.
+type entitySorter struct {
+	ms   []Datastorer
+	vals []reflect.Value
+	less func(a, b reflect.Value) bool
+}
+
+func (es *entitySorter) Len() int {
+	return len(es.ms)
+}
+
+func (es *entitySorter) Less(i, j int) bool {
+	return es.less(es.vals[i], es.vals[j])
+}
+
+func (es *entitySorter) Swap(i, j int) {
+	es.ms[i], es.ms[j] = es.ms[j], es.ms[i]
+	es.vals[i], es.vals[j] = es.vals[j], es.vals[i]
+}
+
+// pageToken is the payload of the tokens created by EncodePageToken.
+type pageToken struct {
+	Limit   int        `json:"l"`
+	Cursor  string     `json:"c"`
+	Filters url.Values `json:"f,omitempty"`
+}
+
+// Lock definitions
+
+// lock is a named lock that is held until its expiration time. Owner is the
+// token of the holder if it was acquired with AcquireLockToken.
+type lock struct {
+	Expiration time.Time `datastore:",noindex"`
+	Owner      string    `datastore:",noindex"`
+}
+
+// AcquireLock attempts to acquire the named lock for the duration of `ttl`,
+// returning true if it is acquired.
+//
+// The lock is not acquired if it is currently held, i.e. it was acquired
+// and has neither been released nor expired. The lock is acquired in a
+// transaction, so only one of the concurrent attempts succeeds.
+//
+// The lock expires after `ttl` so that it does not remain held forever if the
+// holder fails to release it. Choose a `ttl` longer than the task that the
+// lock guards.
+func AcquireLock(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return acquireLock(ctx, name, ttl, "")
+}
+
+// AcquireLockToken acquires the named lock in the same way as AcquireLock,
+// but returns a token that identifies the holder if it is acquired. An empty
+// token is returned if the lock is not acquired.
+//
+// The token is needed to release the lock with ReleaseLockToken.
+func AcquireLockToken(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	b := make([]byte, 16)
+	if _, err := crand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	acquired, err := acquireLock(ctx, name, ttl, token)
+	if err != nil || !acquired {
+		return "", err
+	}
+	return token, nil
+}
+
+// ReleaseLock releases the named lock so that it can be acquired again.
+//
+// Releasing a lock that is not held is not an error.
+func ReleaseLock(ctx context.Context, name string) error {
+	key := datastore.NewKey(ctx, KindLock, name, 0, nil)
+	return datastore.Delete(ctx, key)
+}
+
+// ReleaseLockToken releases the named lock only if it is still held with
+// `token`, i.e. the one returned by AcquireLockToken. This prevents a holder
+// that ran past the expiration of the lock from releasing it after it has
+// been acquired by another.
+//
+// Releasing a lock that is not held is not an error. A ConflictError is
+// returned if the lock is held with another token.
+func ReleaseLockToken(ctx context.Context, name, token string) error {
+	key := datastore.NewKey(ctx, KindLock, name, 0, nil)
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var l lock
+		err := datastore.Get(ctx, key, &l)
+		if err == datastore.ErrNoSuchEntity {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if l.Owner != token {
+			if l.Expiration.After(time.Now()) {
+				return ConflictError{
+					Msg: fmt.Sprintf("lock '%v' is held by another owner", name),
+				}
+			}
+			return nil //expired, i.e. not held
+		}
+		return datastore.Delete(ctx, key)
+	}, nil)
+}
+
+// acquireLock acquires the named lock for `owner` in a transaction, returning
+// true if it is acquired.
+func acquireLock(ctx context.Context, name string, ttl time.Duration,
+	owner string) (bool, error) {
+	acquired := false
+	key := datastore.NewKey(ctx, KindLock, name, 0, nil)
+	err := datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		var l lock
+		err := datastore.Get(ctx, key, &l)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		now := time.Now()
+		if err == nil && l.Expiration.After(now) { //held by another
+			return nil
+		}
+		l.Expiration = now.Add(ttl)
+		l.Owner = owner
+		if _, err := datastore.Put(ctx, key, &l); err != nil {
+			return err
+		}
+		acquired = true
+		return nil
+	}, nil)
+	if err == datastore.ErrConcurrentTransaction { //acquired by another
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return acquired, nil
+}
+
 // Page definitions
 
 // Page describes the contents for a page. It is to be used with templates.
@@ -375,6 +1393,24 @@ func (p *Page) AddVar(word, meaning string) {
 	p.Dictionary[word] = meaning
 }
 
+// MarshalJSON converts the page into a JSON object for hydrating client-side
+// applications, like
+//
+//	{"title":"...","description":"...","dictionary":{...}}
+//
+// where "dictionary" is the result of ToDictionary. The other fields (e.g.
+// Handler and Template) are not included.
+//
+// Note that this has a pointer receiver, so a pointer to the page should be
+// marshalled.
+func (p *Page) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Title       string                 `json:"title"`
+		Description string                 `json:"description"`
+		Dictionary  map[string]interface{} `json:"dictionary"`
+	}{p.Title, p.Description, p.ToDictionary()})
+}
+
 // ToDictionary creates a map with the existing values in the `Dictionary`
 // field combined with the `Title` and `Description` fields.
 //
@@ -400,11 +1436,16 @@ func (p *Page) ToDictionary() map[string]interface{} {
 //
 // Any value that it needs to store should be jsonified and stored as a string
 // in the Value field.
+//
+// ExpiresAt holds the same time as Expiration but is indexed so that expired
+// sessions can be queried (see PurgeExpiredSessions). Sessions created before
+// the field was introduced do not have it and are not found by such queries.
 type Session struct {
 	KeyID      *datastore.Key `datastore:"-"`
 	Name       string         `datastore:",noindex"`
 	Value      string         `datastore:",noindex"`
 	Expiration time.Time      `datastore:",noindex"`
+	ExpiresAt  time.Time
 }
 
 // Valid returns true if the Expiration field is after the current time.
@@ -420,53 +1461,391 @@ func (s *Session) Valid() bool {
 	return true
 }
 
+// SessionCookieOptions specifies the attributes of the cookie created by
+// MakeSessionCookieOpts. See `http.Cookie` for the meaning of each field.
+type SessionCookieOptions struct {
+	Domain   string
+	HttpOnly bool
+	Path     string
+	SameSite http.SameSite
+	Secure   bool
+}
+
+// AuthorizeSession checks that the session is valid (with VerifySession) and
+// that the `roleField` of its value has the required role. The value must be
+// a JSON object, where the field can either be a single role or an array of
+// roles, e.g.
+//
+//	{"userID": "u1", "role": "admin"}
+//	{"userID": "u1", "roles": ["editor", "admin"]}
+//
+// An UnauthorizedError is returned if the session does not have the role.
+// The errors of VerifySession are returned as is, and a JSONUnmarshalError is
+// returned if the value is not a JSON object.
+func AuthorizeSession(ctx context.Context, sessID string, requiredRole string,
+	roleField string) (bool, error) {
+	s, err := VerifySession(ctx, sessID)
+	if err != nil {
+		return false, err
+	}
+	var value map[string]interface{}
+	if e := json.Unmarshal([]byte(s.Value), &value); e != nil {
+		return false, JSONUnmarshalError{
+			Msg: "AuthorizeSession - session value",
+			Err: e,
+		}
+	}
+	switch role := value[roleField].(type) {
+	case string:
+		if role == requiredRole {
+			return true, nil
+		}
+	case []interface{}:
+		for _, r := range role {
+			if r == requiredRole {
+				return true, nil
+			}
+		}
+	}
+	return false, UnauthorizedError{
+		Msg: fmt.Sprintf("role '%v' is required", requiredRole),
+	}
+}
+
 // CheckSession checks for a valid session based on its ID.
 //
 // If the session does not exist, false is returned. If the expiration time of
 // the session is after the current time, returns true. Returns false otherwise.
+//
+// Use VerifySession to find out why a session is not valid.
 func CheckSession(ctx context.Context, sessID string) bool {
-	s := &Session{}
-	item, err := memcache.Get(ctx, sessID) //read from cache
-	if err == nil {                        //i.e. a hit
-		err = json.Unmarshal(item.Value, s)
+	_, err := VerifySession(ctx, sessID)
+	return err == nil //even if cache error, store success
+}
+
+// CheckSessionRetry checks for a valid session based on its ID in the same
+// way as CheckSession, but retries the lookup up to `attempts` times (with an
+// increasing delay starting from 50 milliseconds) if the session is not
+// found. This is for checking a session right after it is created, which may
+// not be found yet because of eventual consistency.
+func CheckSessionRetry(ctx context.Context, sessID string, attempts int) bool {
+	delay := 50 * time.Millisecond
+	for i := 0; ; i++ {
+		s, err := loadSession(ctx, sessID)
+		if err == nil {
+			return s.Valid()
+		}
+		if err != datastore.ErrNoSuchEntity || i+1 >= attempts {
+			return false
+		}
+		time.Sleep(delay)
+		delay *= 2
 	}
-	if err == nil { //i.e. a valid hit
-		return s.Valid()
-	} //else miss or error
+}
 
-	k, err := datastore.DecodeKey(sessID)
-	if err != nil {
+// CheckSessionSliding checks for a valid session based on its ID in the same
+// way as CheckSession.
+//
+// If the session is valid, its expiration time is pushed back by `extend` and
+// the session is updated in both the Datastore and Memcache. This allows an
+// active session to be kept alive by checking it.
+//
+// The return value only reflects the validity of the session - a failure to
+// update the expiration time is ignored.
+func CheckSessionSliding(ctx context.Context, sessID string, extend time.Duration) bool {
+	s, err := loadSession(ctx, sessID)
+	if err != nil || !s.Valid() {
 		return false
 	}
-	err = datastore.Get(ctx, k, s)
-	if err != nil {
-		return false
-	} //else update the cache
+	id, k, _ := sessionKey(sessID) //already verified by loadSession
+	s.Expiration = s.Expiration.Add(extend)
+	s.ExpiresAt = s.Expiration
+	if _, err := datastore.Put(ctx, k, s); err != nil {
+		return true //still valid, just not extended
+	}
 	if _s, err := json.Marshal(s); err == nil {
 		item := &memcache.Item{
-			Key:   sessID,
+			Key:   id,
 			Value: _s,
 		}
-		memcache.Add(ctx, item) //ignore any error
-	} //else marshalling error - cannot cache
-	return s.Valid() //even if cache error, store success
+		memcache.Set(ctx, item) //ignore any error
+	}
+	return true
 }
 
-// MakeSessionCookie creates a session and a cookie based on the database Key
-// encoded value.
+// DecodeSessionValues unmarshals the values of the sessions into the
+// corresponding elements of `dst`, which must be a pointer to a slice, e.g.
 //
-// The session is also placed in Memcache in addition to the Datastore.
+//	var users []User
+//	err := DecodeSessionValues(sessions, &users)
 //
-// The `obj` parameter is the value to be stored in the cookie. It is JSONified
-// before storing as a string. The `duration` parameter is the number of
-// seconds for which the cookie is to be valid.
-func MakeSessionCookie(ctx context.Context, name string, obj interface{},
-	duration int64) (*http.Cookie, error) {
-	dur := time.Duration(duration) * time.Second
-	exp := time.Now().Add(dur)
-	s := &Session{
-		Name:       name,
+// The slice is resized to the number of sessions. Sessions that are nil or
+// have no value are skipped, leaving the zero value in their elements.
+//
+// A TypeError is returned if `dst` is not a pointer to a slice, and a
+// JSONUnmarshalError is returned if a value cannot be unmarshalled.
+func DecodeSessionValues(sessions []*Session, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Slice {
+		return TypeError{
+			Name:  "dst",
+			Cause: "must be a pointer to a slice",
+		}
+	}
+	slice := reflect.MakeSlice(v.Elem().Type(), len(sessions), len(sessions))
+	for i, s := range sessions {
+		if s == nil || s.Value == "" {
+			continue
+		}
+		if e := json.Unmarshal([]byte(s.Value), slice.Index(i).Addr().Interface()); e != nil {
+			return JSONUnmarshalError{
+				Msg: fmt.Sprintf("DecodeSessionValues - session at index %d", i),
+				Err: e,
+			}
+		}
+	}
+	v.Elem().Set(slice)
+	return nil
+}
+
+// DestroySession invalidates a session (e.g. on logout) by removing it from
+// both the Datastore and Memcache.
+//
+// A session that does not exist (e.g. it has already been destroyed) is
+// ignored, i.e. nil is returned. An InvalidError is returned if the session
+// ID is malformed.
+func DestroySession(ctx context.Context, sessID string) error {
+	id, k, err := sessionKey(sessID)
+	if err != nil {
+		return err
+	}
+	memcache.Delete(ctx, id) //ignore any error
+	err = datastore.Delete(ctx, k)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// GetSessionValue retrieves the session (from Memcache first, like
+// CheckSession) and unmarshals the value stored by MakeSessionCookie into
+// `dest`, which should be a pointer.
+//
+// ErrUnauth is returned if the session does not exist or has expired, and an
+// InvalidError is returned if the session ID is malformed. If the value
+// cannot be unmarshalled into `dest`, a JSONUnmarshalError is returned. If no
+// value was stored, `dest` is left unchanged.
+func GetSessionValue(ctx context.Context, sessID string, dest interface{}) error {
+	s, err := loadSession(ctx, sessID)
+	if err == datastore.ErrNoSuchEntity || (err == nil && !s.Valid()) {
+		return ErrUnauth
+	}
+	if err != nil {
+		return err
+	}
+	if s.Value == "" {
+		return nil
+	}
+	if e := json.Unmarshal([]byte(s.Value), dest); e != nil {
+		return JSONUnmarshalError{
+			Msg: "GetSessionValue - session value",
+			Err: e,
+		}
+	}
+	return nil
+}
+
+// ValidateSessions checks a batch of sessions based on their IDs and returns
+// the valid sessions mapped by their IDs. Sessions that are expired, do not
+// exist or have invalid IDs are omitted.
+//
+// The sessions are retrieved from Memcache in a single batch. Those that are
+// not in the cache are then retrieved from the Datastore in a single batch
+// and placed into Memcache.
+func ValidateSessions(ctx context.Context, ids []string) map[string]*Session {
+	valid := make(map[string]*Session)
+	verified := make(map[string]string) //session ID to unsigned ID
+	cacheKeys := make([]string, 0, len(ids))
+	for _, sessID := range ids {
+		if id, _, err := sessionKey(sessID); err == nil {
+			verified[sessID] = id
+			cacheKeys = append(cacheKeys, id)
+		}
+	}
+	items, err := memcache.GetMulti(ctx, cacheKeys) //read from cache
+	if err != nil {
+		items = nil //treat as all misses
+	}
+	missed := make([]string, 0)
+	keys := make([]*datastore.Key, 0)
+	for _, sessID := range ids {
+		id, ok := verified[sessID]
+		if !ok {
+			continue
+		}
+		if item, ok := items[id]; ok { //i.e. a hit
+			s := &Session{}
+			if json.Unmarshal(item.Value, s) == nil { //i.e. a valid hit
+				if s.Valid() {
+					valid[sessID] = s
+				}
+				continue
+			}
+		} //else miss or error
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			continue
+		}
+		missed = append(missed, sessID)
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return valid
+	}
+	sessions := make([]Session, len(keys))
+	err = datastore.GetMulti(ctx, keys, sessions)
+	merr, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return valid
+	}
+	cache := make([]*memcache.Item, 0, len(keys))
+	for i, sessID := range missed {
+		if merr != nil && merr[i] != nil {
+			continue
+		}
+		s := &sessions[i]
+		if _s, err := json.Marshal(s); err == nil {
+			cache = append(cache, &memcache.Item{
+				Key:   verified[sessID],
+				Value: _s,
+			})
+		} //else marshalling error - cannot cache
+		if s.Valid() {
+			valid[sessID] = s
+		}
+	}
+	memcache.AddMulti(ctx, cache) //ignore any error
+	return valid
+}
+
+// loadSession retrieves the session from Memcache, falling back to the
+// Datastore if it is not in the cache.
+//
+// If the session is retrieved from the Datastore, it is placed into Memcache.
+//
+// An InvalidError is returned without looking up the session if the session
+// ID is malformed (see sessionKey).
+func loadSession(ctx context.Context, sessID string) (*Session, error) {
+	id, k, err := sessionKey(sessID)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	item, err := memcache.Get(ctx, id) //read from cache
+	if err == nil {                    //i.e. a hit
+		err = json.Unmarshal(item.Value, s)
+	}
+	if err == nil { //i.e. a valid hit
+		return s, nil
+	} //else miss or error
+
+	err = datastore.Get(ctx, k, s)
+	if err != nil {
+		return nil, err
+	} //else update the cache
+	if _s, err := json.Marshal(s); err == nil {
+		item := &memcache.Item{
+			Key:   id,
+			Value: _s,
+		}
+		memcache.Add(ctx, item) //ignore any error
+	} //else marshalling error - cannot cache
+	return s, nil
+}
+
+// sessionKey verifies the signature of the session ID (see verifySessionID)
+// and decodes the key of the session from it, returning both the ID without
+// the signature and the key.
+//
+// An InvalidError is returned if the signature does not verify or the ID is
+// not the key of a session, so that all the session functions reject a
+// malformed or tampered session ID in the same way.
+func sessionKey(sessID string) (string, *datastore.Key, error) {
+	id, ok := verifySessionID(sessID)
+	k, err := datastore.DecodeKey(id)
+	if !ok || err != nil || k.Kind() != KindSession {
+		return "", nil, InvalidError{
+			Msg: fmt.Sprintf("'%v' is not a valid session ID", sessID),
+		}
+	}
+	return id, k, nil
+}
+
+// signSessionID appends the signature of the session ID to it, separated by
+// a period. The ID is returned as is if SessionSigningKey is not set.
+func signSessionID(id string) string {
+	if len(SessionSigningKey) == 0 {
+		return id
+	}
+	mac := hmac.New(sha256.New, SessionSigningKey)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySessionID checks the signature of a session ID signed by
+// signSessionID and returns the ID without the signature. If
+// SessionSigningKey is not set, the session ID is returned as is.
+func verifySessionID(sessID string) (string, bool) {
+	if len(SessionSigningKey) == 0 {
+		return sessID, true
+	}
+	i := strings.LastIndex(sessID, ".")
+	if i < 0 {
+		return "", false
+	}
+	id := sessID[:i]
+	if !hmac.Equal([]byte(signSessionID(id)), []byte(sessID)) {
+		return "", false
+	}
+	return id, true
+}
+
+// MakeSessionCookie creates a session and a cookie based on the database Key
+// encoded value. If SessionSigningKey is set, the value is signed.
+//
+// The session is also placed in Memcache in addition to the Datastore.
+//
+// The `obj` parameter is the value to be stored in the cookie. It is JSONified
+// before storing as a string. The `duration` parameter is the number of
+// seconds for which the cookie is to be valid.
+//
+// The cookie is HttpOnly so that it cannot be accessed by scripts. Use
+// MakeSessionCookieOpts to specify the attributes of the cookie.
+func MakeSessionCookie(ctx context.Context, name string, obj interface{},
+	duration int64) (*http.Cookie, error) {
+	return MakeSessionCookieOpts(ctx, name, obj, duration, SessionCookieOptions{
+		HttpOnly: true,
+	})
+}
+
+// MakeSessionCookieOpts creates a session and a cookie in the same way as
+// MakeSessionCookie, with the attributes of the cookie set according to
+// `opts`, e.g.
+//
+//	MakeSessionCookieOpts(ctx, "session", user, 3600, SessionCookieOptions{
+//		HttpOnly: true,
+//		Path:     "/",
+//		SameSite: http.SameSiteLaxMode,
+//		Secure:   true,
+//	})
+func MakeSessionCookieOpts(ctx context.Context, name string, obj interface{},
+	duration int64, opts SessionCookieOptions) (*http.Cookie, error) {
+	dur := time.Duration(duration) * time.Second
+	exp := time.Now().Add(dur)
+	s := &Session{
+		Name:       name,
 		Expiration: exp,
+		ExpiresAt:  exp,
 	}
 	if obj != nil {
 		if js, e := json.Marshal(obj); e == nil {
@@ -485,14 +1864,515 @@ func MakeSessionCookie(ctx context.Context, name string, obj interface{},
 		memcache.Set(ctx, item)
 	}
 	return &http.Cookie{
-		Name:    name,
-		Value:   key.Encode(),
-		Expires: exp,
+		Name:     name,
+		Value:    signSessionID(key.Encode()),
+		Expires:  exp,
+		Domain:   opts.Domain,
+		HttpOnly: opts.HttpOnly,
+		Path:     opts.Path,
+		SameSite: opts.SameSite,
+		Secure:   opts.Secure,
 	}, nil
 }
 
+// PurgeExpiredSessions deletes up to `limit` expired sessions from the
+// Datastore, together with their items in Memcache, and returns the number
+// of sessions deleted. This is meant to be run periodically, e.g. by a cron
+// handler, since expired sessions are otherwise never deleted.
+//
+// The expired sessions are found with the indexed ExpiresAt field, as
+// Expiration is not indexed. If `limit` is not positive or is above 500 (the
+// limit of `datastore.DeleteMulti`), 500 is used.
+func PurgeExpiredSessions(ctx context.Context, limit int) (int, error) {
+	if limit <= 0 || limit > 500 {
+		limit = 500
+	}
+	q := datastore.NewQuery(KindSession).Filter("ExpiresAt <", time.Now()).
+		KeysOnly().Limit(limit)
+	keys, err := q.GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	ids := make([]string, len(keys))
+	for i, k := range keys {
+		ids[i] = k.Encode()
+	}
+	memcache.DeleteMulti(ctx, ids) //ignore any error
+	if e := datastore.DeleteMulti(ctx, keys); e != nil {
+		return 0, e
+	}
+	return len(keys), nil
+}
+
+// RefreshSession pushes back the expiration time of an existing session to
+// `duration` seconds from now, without creating a new session. The session
+// is updated in both the Datastore and Memcache.
+//
+// The returned cookie has the same value (i.e. the session ID) as before,
+// with the new expiration time. Like MakeSessionCookie, the cookie is
+// HttpOnly. Use RefreshSessionOpts to specify the attributes of the cookie,
+// which should be the same as those used to create it so that it replaces
+// the original cookie.
+//
+// A NotFoundError is returned if the session does not exist or has already
+// expired, and an InvalidError is returned if the session ID is malformed.
+func RefreshSession(ctx context.Context, sessID string, duration int64) (*http.Cookie, error) {
+	return RefreshSessionOpts(ctx, sessID, duration, SessionCookieOptions{
+		HttpOnly: true,
+	})
+}
+
+// RefreshSessionOpts refreshes a session in the same way as RefreshSession,
+// with the attributes of the returned cookie set according to `opts`.
+func RefreshSessionOpts(ctx context.Context, sessID string, duration int64,
+	opts SessionCookieOptions) (*http.Cookie, error) {
+	id, k, err := sessionKey(sessID)
+	if err != nil {
+		return nil, err
+	}
+	s := &Session{}
+	err = datastore.Get(ctx, k, s)
+	if err == datastore.ErrNoSuchEntity || (err == nil && !s.Valid()) {
+		return nil, NotFoundError{
+			Kind: KindSession,
+			Err:  err,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.Expiration = time.Now().Add(time.Duration(duration) * time.Second)
+	s.ExpiresAt = s.Expiration
+	if _, err := datastore.Put(ctx, k, s); err != nil {
+		return nil, err
+	}
+	if _s, err := json.Marshal(s); err == nil {
+		item := &memcache.Item{
+			Key:   id,
+			Value: _s,
+		}
+		memcache.Set(ctx, item) //ignore any error
+	}
+	return &http.Cookie{
+		Name:     s.Name,
+		Value:    sessID,
+		Expires:  s.Expiration,
+		Domain:   opts.Domain,
+		HttpOnly: opts.HttpOnly,
+		Path:     opts.Path,
+		SameSite: opts.SameSite,
+		Secure:   opts.Secure,
+	}, nil
+}
+
+// SessionFromRequest gets the session ID from the named cookie of the request
+// and checks the session with CheckSession, returning both the validity and
+// the ID.
+//
+// If the request does not have the cookie, false and an empty ID are
+// returned.
+func SessionFromRequest(ctx context.Context, r *http.Request, cookieName string) (valid bool, sessID string) {
+	c, err := r.Cookie(cookieName)
+	if err != nil || c.Value == "" {
+		return false, ""
+	}
+	return CheckSession(ctx, c.Value), c.Value
+}
+
+// UpdateSessionValue replaces the value of an existing session with the
+// JSONified `obj`, e.g. to keep a snapshot of a shopping cart as the user
+// shops. The name and expiration of the session are left untouched. The
+// session is updated in both the Datastore and Memcache.
+//
+// A NotFoundError is returned if the session does not exist or has already
+// expired, and an InvalidError is returned if the session ID is malformed.
+func UpdateSessionValue(ctx context.Context, sessID string, obj interface{}) error {
+	id, k, err := sessionKey(sessID)
+	if err != nil {
+		return err
+	}
+	js, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	s := &Session{}
+	err = datastore.Get(ctx, k, s)
+	if err == datastore.ErrNoSuchEntity || (err == nil && !s.Valid()) {
+		return NotFoundError{
+			Kind: KindSession,
+			Err:  err,
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.Value = string(js)
+	if _, err := datastore.Put(ctx, k, s); err != nil {
+		return err
+	}
+	if _s, err := json.Marshal(s); err == nil {
+		item := &memcache.Item{
+			Key:   id,
+			Value: _s,
+		}
+		memcache.Set(ctx, item) //ignore any error
+	}
+	return nil
+}
+
+// VerifySession checks for a valid session based on its ID in the same way
+// as CheckSession, but returns the session if it is valid and the reason if
+// it is not:
+//
+//   - InvalidError if the session ID is malformed or its signature does not
+//     verify (see SessionSigningKey)
+//   - NotFoundError if the session does not exist
+//   - ValidityError if the session has expired
+//
+// Any other error from retrieving the session is returned as is.
+func VerifySession(ctx context.Context, sessID string) (*Session, error) {
+	s, err := loadSession(ctx, sessID)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, NotFoundError{
+			Kind: KindSession,
+			Err:  err,
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !s.Valid() {
+		return nil, ValidityError{
+			Msg: "session has expired",
+		}
+	}
+	return s, nil
+}
+
+// Timings definitions
+
+// Timings collects the durations of the sub-operations of a request so that
+// they can be reported to the browser in the "Server-Timing" header, e.g.
+//
+//	timings := NewTimings()
+//	start := time.Now()
+//	err := LoadByID(ctx, id, &order)
+//	timings.Record("db", time.Since(start))
+//	...
+//	timings.Write(w)
+//
+// It is safe for concurrent use.
+type Timings struct {
+	mu      sync.Mutex
+	entries []timing
+}
+
+// timing is a single entry of Timings.
+type timing struct {
+	name string
+	dur  time.Duration
+}
+
+// Record adds the duration of the named operation. The name should be a
+// token, i.e. without spaces, commas or semicolons. Recording the same name
+// more than once adds multiple entries.
+func (t *Timings) Record(name string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, timing{name, d})
+}
+
+// Write sets the "Server-Timing" header with the recorded durations in
+// milliseconds, in the order they were recorded, e.g.
+//
+//	Server-Timing: db;dur=12.5, cache;dur=0.8
+//
+// This must be called before the response header is written. Nothing is set
+// if no durations are recorded.
+func (t *Timings) Write(w http.ResponseWriter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.entries) == 0 {
+		return
+	}
+	parts := make([]string, len(t.entries))
+	for i, e := range t.entries {
+		ms := float64(e.dur) / float64(time.Millisecond)
+		parts[i] = e.name + ";dur=" + strconv.FormatFloat(ms, 'f', -1, 64)
+	}
+	w.Header().Set(http.CanonicalHeaderKey("Server-Timing"), strings.Join(parts, ", "))
+}
+
+// NewTimings creates a new Timings for collecting the durations of the
+// sub-operations of a request.
+func NewTimings() *Timings {
+	return &Timings{}
+}
+
 // FUNCTION definitions
 
+// ApplyMergePatch applies a JSON Merge Patch (RFC 7396) to the entity with
+// the key `k`, then saves it.
+//
+// The entity is loaded into m and converted to JSON, after which the patch is
+// applied: the fields in the patch replace those of the entity, and the
+// fields that are null in the patch are removed (i.e. zeroed). Only the
+// fields named at the top level of the patch are then set on m from the
+// result, so the other fields (including those that are not in the JSON form
+// of m) keep the values that were loaded. The entity is saved with Save, so
+// the validity check and pre-saving operation apply. All of these are
+// performed in a transaction.
+//
+// The model must be a pointer to a struct. If the patch is not valid JSON, a
+// JSONUnmarshalError is returned.
+func ApplyMergePatch(ctx context.Context, k *datastore.Key, patch []byte,
+	m Datastorer) error {
+	if k == nil {
+		return ErrNilKey
+	}
+	var p interface{}
+	if e := json.Unmarshal(patch, &p); e != nil {
+		return JSONUnmarshalError{
+			Msg: "merge patch",
+			Err: e,
+		}
+	}
+	v := reflect.ValueOf(m)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return TypeError{
+			Name:  fmt.Sprintf("%T", m),
+			Cause: "not a pointer to a struct",
+		}
+	}
+	return datastore.RunInTransaction(ctx, func(ctx context.Context) error {
+		if e := LoadByKey(ctx, k, m); e != nil {
+			return e
+		}
+		j, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		var doc interface{}
+		if e := json.Unmarshal(j, &doc); e != nil {
+			return e
+		}
+		merged, _ := mergePatch(doc, p).(map[string]interface{})
+		fields, _ := p.(map[string]interface{})
+		changed := make(map[string]interface{})
+		for name, val := range fields {
+			if f := jsonField(v.Elem(), name); f.IsValid() {
+				f.Set(reflect.Zero(f.Type()))
+			}
+			if val != nil {
+				changed[name] = merged[name]
+			}
+		}
+		j, err = json.Marshal(changed)
+		if err != nil {
+			return err
+		}
+		if e := json.Unmarshal(j, m); e != nil {
+			return JSONUnmarshalError{
+				Msg: "merge patch",
+				Err: e,
+			}
+		}
+		m.SetKey(k)
+		return Save(ctx, m)
+	}, nil)
+}
+
+// jsonField finds the field of the struct `v` that has the JSON name `name`,
+// matching it in the same way as `encoding/json` (i.e. preferring an exact
+// match over a case-insensitive one). The fields of embedded structs are
+// included. The zero Value is returned if there is no such field.
+func jsonField(v reflect.Value, name string) reflect.Value {
+	var fold reflect.Value
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		fname := strings.Split(tag, ",")[0]
+		if sf.Anonymous && fname == "" && sf.Type.Kind() == reflect.Struct {
+			if f := jsonField(v.Field(i), name); f.IsValid() {
+				return f
+			}
+			continue
+		}
+		if sf.PkgPath != "" { //unexported
+			continue
+		}
+		if fname == "" {
+			fname = sf.Name
+		}
+		if fname == name {
+			return v.Field(i)
+		}
+		if !fold.IsValid() && strings.EqualFold(fname, name) {
+			fold = v.Field(i)
+		}
+	}
+	return fold
+}
+
+// mergePatch applies the patch to the target according to RFC 7396, returning
+// the result.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// CacheConsistent checks whether the copy of the entity in memcache (as
+// cached by SaveCacheEntity or RetrieveEntityByID) matches the one in the
+// Datastore. This is meant for investigating caching bugs.
+//
+// The entity is loaded from the Datastore into `m`, which must be a pointer,
+// and compared with the cached copy using EntitiesEqual. As the copy is
+// cached as JSON, the entity is compared in its JSON form (e.g. DateTime
+// values without sub-second precision and without the fields tagged
+// `json:"-"`). A cache miss is considered consistent, while a cached copy
+// that cannot be unmarshalled is considered inconsistent.
+func CacheConsistent(ctx context.Context, k *datastore.Key, m Datastorer) (bool, error) {
+	t := reflect.TypeOf(m)
+	if t.Kind() != reflect.Ptr {
+		return false, TypeError{
+			Name:  t.String(),
+			Cause: "model must be a pointer",
+		}
+	}
+	if e := LoadByKey(ctx, k, m); e != nil {
+		return false, e
+	}
+	item, err := memcache.Get(ctx, k.Encode())
+	if err == memcache.ErrCacheMiss {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	cached := reflect.New(t.Elem()).Interface().(Datastorer)
+	if e := json.Unmarshal(item.Value, cached); e != nil {
+		return false, nil
+	}
+	//compare at the precision that the cache keeps
+	j, err := json.Marshal(m)
+	if err != nil {
+		return false, err
+	}
+	stored := reflect.New(t.Elem()).Interface().(Datastorer)
+	if e := json.Unmarshal(j, stored); e != nil {
+		return false, e
+	}
+	return EntitiesEqual(stored, cached), nil
+}
+
+// Capabilities returns the names of the optional interfaces that the model
+// implements, in alphabetical order. The interfaces checked are:
+//
+//   - CacheInvalidator
+//   - PartialValidator
+//   - Presaver
+//   - PropertyLoadSaver (from the datastore package)
+//
+// This is meant for debugging and generic tooling that needs to know how a
+// model will be handled, e.g. whether Save calls Presave on it.
+func Capabilities(m Datastorer) []string {
+	caps := []string{}
+	if _, ok := m.(CacheInvalidator); ok {
+		caps = append(caps, "CacheInvalidator")
+	}
+	if _, ok := m.(PartialValidator); ok {
+		caps = append(caps, "PartialValidator")
+	}
+	if _, ok := m.(Presaver); ok {
+		caps = append(caps, "Presaver")
+	}
+	if _, ok := m.(datastore.PropertyLoadSaver); ok {
+		caps = append(caps, "PropertyLoadSaver")
+	}
+	return caps
+}
+
+// DecodeKeys converts the opaque representations of keys into keys, e.g. for
+// a query parameter like "?ids=key1,key2,key3":
+//
+//	keys, err := DecodeKeys(strings.Split(r.URL.Query().Get("ids"), ","))
+//
+// An InvalidError identifying the position of the first ID that cannot be
+// decoded is returned if any of them is invalid.
+func DecodeKeys(ids []string) ([]*datastore.Key, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		k, err := datastore.DecodeKey(id)
+		if err != nil {
+			return nil, InvalidError{
+				Msg: fmt.Sprintf("ID at index %d ('%v'): %v", i, id, err),
+			}
+		}
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+// DecodePageToken verifies and decodes a token created by EncodePageToken,
+// returning the limit, the cursor and the filters in it.
+//
+// A MissingError is returned if PageTokenSecret is not set, and an
+// InvalidError is returned if the token is malformed or has been tampered
+// with.
+func DecodePageToken(token string) (int, string, url.Values, error) {
+	if len(PageTokenSecret) == 0 {
+		return 0, "", nil, MissingError{
+			Msg: "PageTokenSecret is not set",
+		}
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return 0, "", nil, InvalidError{
+			Msg: "malformed page token",
+		}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return 0, "", nil, InvalidError{
+			Msg: "malformed page token",
+		}
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signPageToken(payload)) {
+		return 0, "", nil, InvalidError{
+			Msg: "page token signature does not match",
+		}
+	}
+	var pt pageToken
+	if e := json.Unmarshal(payload, &pt); e != nil {
+		return 0, "", nil, InvalidError{
+			Msg: "malformed page token",
+		}
+	}
+	return pt.Limit, pt.Cursor, pt.Filters, nil
+}
+
 // DeleteByID removes an entity from the Datastore and memcache using the opaque
 // representation of the key.
 //
@@ -517,37 +2397,307 @@ func DeleteByKey(ctx context.Context, k *datastore.Key) error {
 	return datastore.Delete(ctx, k)
 }
 
+// DeleteEntity removes the entity from the Datastore and memcache like
+// DeleteByKey.
+//
+// If m implements CacheInvalidator, the items with its related cache keys are
+// also removed from memcache.
+func DeleteEntity(ctx context.Context, m Datastorer) error {
+	if m.Key() == nil {
+		return ErrNilKey
+	}
+	if e := DeleteByKey(ctx, m.Key()); e != nil {
+		return e
+	}
+	evictRelated(ctx, m)
+	return nil
+}
+
+// EncodePageToken creates an opaque token holding the pagination limit, the
+// cursor and the filters of a query. This is for exposing to clients in
+// place of the Datastore cursor so that the implementation details are not
+// leaked.
+//
+// The token is a base64url-encoded JSON payload followed by its HMAC-SHA256
+// signature (using PageTokenSecret), separated by a period. Use
+// DecodePageToken to verify and read the token.
+func EncodePageToken(limit int, cursor string, filters url.Values) (string, error) {
+	if len(PageTokenSecret) == 0 {
+		return "", MissingError{
+			Msg: "PageTokenSecret is not set",
+		}
+	}
+	payload, err := json.Marshal(pageToken{
+		Limit:   limit,
+		Cursor:  cursor,
+		Filters: filters,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(signPageToken(payload)), nil
+}
+
+// EnsureKeyMatches checks that the key of the model matches the opaque
+// representation of the key in `pathID`, e.g. the ID in the URL path of a
+// PUT request. This prevents the payload from overwriting a different entity
+// than the one specified in the path.
+//
+// A MismatchError is returned if the model has a key that is different from
+// `pathID`. A model without a key is considered to match.
+func EnsureKeyMatches(pathID string, m Datastorer) error {
+	k := m.Key()
+	if k == nil {
+		return nil
+	}
+	if k.Encode() != pathID {
+		return MismatchError{
+			Msg: fmt.Sprintf("ID in path '%v' is different from ID of entity '%v'",
+				pathID, k.Encode()),
+		}
+	}
+	return nil
+}
+
+// EntitiesEqual checks if two entities would be stored identically in the
+// Datastore, i.e. they have the same properties with the same values. Their
+// keys are not compared.
+//
+// Time values are compared to the microsecond, which is the precision that
+// the Datastore stores them in, regardless of their locations.
+//
+// If the properties of either entity cannot be determined, they are
+// considered to be different.
+func EntitiesEqual(a, b Datastorer) bool {
+	pa, err := saveProperties(a)
+	if err != nil {
+		return false
+	}
+	pb, err := saveProperties(b)
+	if err != nil {
+		return false
+	}
+	if len(pa) != len(pb) {
+		return false
+	}
+	for i := range pa {
+		if pa[i].Name != pb[i].Name || pa[i].NoIndex != pb[i].NoIndex ||
+			pa[i].Multiple != pb[i].Multiple {
+			return false
+		}
+		if ta, ok := pa[i].Value.(time.Time); ok {
+			tb, ok := pb[i].Value.(time.Time)
+			if !ok || !ta.Truncate(time.Microsecond).Equal(tb.Truncate(time.Microsecond)) {
+				return false
+			}
+		} else if !reflect.DeepEqual(pa[i].Value, pb[i].Value) {
+			return false
+		}
+	}
+	return true
+}
+
+// GroupCount counts the entities of `kind` grouped by the distinct values of
+// `field`.
+//
+// The keys of the returned map are the values as stored in the Datastore,
+// e.g. int64 for the int types and string for strings. Values that cannot be
+// compared as map keys are converted: keys are encoded with
+// `datastore.Key.Encode` and byte strings are converted to strings.
+//
+// This runs a projection query on `field`, therefore the field must be
+// indexed. Entities without the field (or where the field is not indexed)
+// are not counted. Note that every entity of the kind is read, so the cost
+// grows linearly with the number of entities - for large kinds, consider
+// maintaining a sharded counter per group instead.
+func GroupCount(ctx context.Context, kind, field string) (map[interface{}]int, error) {
+	counts := make(map[interface{}]int)
+	q := datastore.NewQuery(kind).Project(field)
+	for it := q.Run(ctx); ; {
+		var props datastore.PropertyList
+		_, err := it.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range props {
+			if p.Name != field {
+				continue
+			}
+			switch v := p.Value.(type) {
+			case *datastore.Key:
+				counts[v.Encode()]++
+			case datastore.ByteString:
+				counts[string(v)]++
+			case []byte:
+				counts[string(v)]++
+			default:
+				counts[v]++
+			}
+		}
+	}
+	return counts, nil
+}
+
+// IsInternalRequest checks if the request was made by App Engine itself, i.e.
+// by the Cron Service or the Task Queue.
+//
+// This relies on the HeaderCron and HeaderQueueName headers which App Engine
+// removes from external requests, so they cannot be spoofed. It is meant for
+// guarding handlers that perform privileged maintenance work.
+func IsInternalRequest(r *http.Request) bool {
+	if r.Header.Get(HeaderCron) == "true" {
+		return true
+	}
+	return r.Header.Get(HeaderQueueName) != ""
+}
+
 // IsValid checks if a Datastorer has satisfied its validation rules.
 func IsValid(m Datastorer) bool {
 	if len(m.ValidationError()) > 0 {
 		return false
 	}
-	return true
+	return true
+}
+
+// KeyForID creates a complete root key of `kind` with the numeric ID.
+//
+// This is a shorthand for:
+//
+//	datastore.NewKey(ctx, kind, "", id, nil)
+func KeyForID(ctx context.Context, kind string, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, kind, "", id, nil)
+}
+
+// KeyForName creates a complete root key of `kind` with the string ID. This
+// is meant for entities that are identified by a natural identifier such as
+// an email address or a username.
+//
+// This is a shorthand for:
+//
+//	datastore.NewKey(ctx, kind, name, 0, nil)
+func KeyForName(ctx context.Context, kind, name string) *datastore.Key {
+	return datastore.NewKey(ctx, kind, name, 0, nil)
+}
+
+// LoadByID retrieves a model from the Datastore using the opaque
+// representation of the key.
+//
+// LoadByKey is called after conversion of the ID.
+func LoadByID(ctx context.Context, id string, m Datastorer) error {
+	key, err := datastore.DecodeKey(id)
+	if err != nil {
+		return err
+	}
+	return LoadByKey(ctx, key, m)
+}
+
+// LoadByKey retrieves a model from the Datastore.
+//
+// The SetKey method of Datastore is called to set the key (and any other
+// properties determined by the implementation) after retrieving from the
+// Datastore.
+func LoadByKey(ctx context.Context, k *datastore.Key, m Datastorer) error {
+	if e := datastore.Get(ctx, k, m); e != nil {
+		return e
+	}
+	m.SetKey(k)
+	return nil
+}
+
+// MergeValidationErrors combines the validation errors of several models,
+// e.g. the sub-models of a composite request, into a single slice. The order
+// of the messages is kept, and exact duplicates are only included once.
+//
+// An empty slice is returned if there are no errors.
+func MergeValidationErrors(errs ...[]string) []string {
+	merged := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, msgs := range errs {
+		for _, msg := range msgs {
+			if seen[msg] {
+				continue
+			}
+			seen[msg] = true
+			merged = append(merged, msg)
+		}
+	}
+	return merged
+}
+
+// MustLoadByID retrieves a model from the Datastore using the opaque
+// representation of the key, like LoadByID, but returns errors that can be
+// mapped directly to responses:
+//
+//   - InvalidError if the ID is not a valid key
+//   - NotFoundError with the specified kind if the entity does not exist
+//
+// Any other error is returned as is.
+func MustLoadByID(ctx context.Context, id string, kind string, m Datastorer) error {
+	key, err := datastore.DecodeKey(id)
+	if err != nil {
+		return InvalidError{
+			Msg: fmt.Sprintf("'%v' is not a valid ID", id),
+		}
+	}
+	if e := LoadByKey(ctx, key, m); e != nil {
+		if e == datastore.ErrNoSuchEntity {
+			return NotFoundError{
+				Kind: kind,
+			}
+		}
+		return e
+	}
+	return nil
 }
 
-// LoadByID retrieves a model from the Datastore using the opaque
-// representation of the key.
+// NormalizeEmail trims and lowercases an email address so that the same
+// address is always stored the same way, e.g. for checking duplicates. It is
+// meant to be used in the Presave or ValidationError methods of models.
 //
-// LoadByKey is called after conversion of the ID.
-func LoadByID(ctx context.Context, id string, m Datastorer) error {
-	key, err := datastore.DecodeKey(id)
-	if err != nil {
-		return err
+// An InvalidError is returned if the address is not in the basic form of
+// "local@domain" (as parsed by `net/mail`), including when it has a display
+// name, e.g. "Name <local@domain>".
+func NormalizeEmail(s string) (string, error) {
+	email := strings.ToLower(strings.TrimSpace(s))
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", InvalidError{
+			Msg: fmt.Sprintf("'%v' is not a valid email address", s),
+		}
 	}
-	return LoadByKey(ctx, key, m)
+	return email, nil
 }
 
-// LoadByKey retrieves a model from the Datastore.
+// PageMeta computes the metadata for numbered pagination from the total
+// number of results, the number of results per page and the offset of the
+// current page, returning:
 //
-// The SetKey method of Datastore is called to set the key (and any other
-// properties determined by the implementation) after retrieving from the
-// Datastore.
-func LoadByKey(ctx context.Context, k *datastore.Key, m Datastorer) error {
-	if e := datastore.Get(ctx, k, m); e != nil {
-		return e
+//   - page: the current page, starting from 1
+//   - pages: the total number of pages
+//   - hasNext: whether there are results after the current page
+//   - hasPrev: whether there are results before the current page
+//
+// A zero (or negative) limit is treated as having all the results on a single
+// page.
+func PageMeta(total, limit, offset int) (page, pages int, hasNext, hasPrev bool) {
+	if offset < 0 {
+		offset = 0
 	}
-	m.SetKey(k)
-	return nil
+	if limit <= 0 {
+		if total > 0 {
+			pages = 1
+		}
+		return 1, pages, false, false
+	}
+	page = offset/limit + 1
+	pages = (total + limit - 1) / limit
+	hasNext = offset+limit < total
+	hasPrev = offset > 0
+	return
 }
 
 // PrepPageParams parses the query parameters to get the pagination cursor and
@@ -560,13 +2710,175 @@ func LoadByKey(ctx context.Context, k *datastore.Key, m Datastorer) error {
 func PrepPageParams(params url.Values) (limit int, cursor string) {
 	ipp := params.Get("ipp")
 	cursor = params.Get("cursor")
-	limit = 50
+	limit = defaultPageLimit
 	if ipp != "" {
 		limit, _ = strconv.Atoi(ipp)
 	}
 	return
 }
 
+// PrepDateRange parses the query parameters to get a range of time.
+//
+// The start and end of the range should be specified as "from" and "to"
+// respectively, in the format "YYYY-MM-DDTHH:mm:ss+HH:mm". Either of them may
+// be omitted, in which case the range is unbounded on that side.
+//
+// An InvalidError is returned if either value is not in the expected format.
+func PrepDateRange(params url.Values) (DateTimeRange, error) {
+	var dtr DateTimeRange
+	if from := params.Get("from"); from != "" {
+		d, err := NewDateTime(from)
+		if err != nil {
+			return DateTimeRange{}, InvalidError{
+				Msg: "from: " + err.Error(),
+			}
+		}
+		dtr.Start = d
+	}
+	if to := params.Get("to"); to != "" {
+		d, err := NewDateTime(to)
+		if err != nil {
+			return DateTimeRange{}, InvalidError{
+				Msg: "to: " + err.Error(),
+			}
+		}
+		dtr.End = d
+	}
+	return dtr, nil
+}
+
+// QueryCacheKey creates a key for caching the results of a query on `kind`
+// described by the query parameters (e.g. filters, order and cursor).
+//
+// The key is in the format "<kind>:<hash>" where the hash is the hex-encoded
+// SHA-256 of the parameters. The parameters are sorted by name before
+// hashing so the order in which they are specified does not matter, but the
+// order of multiple values of the same parameter does.
+func QueryCacheKey(kind string, params url.Values) string {
+	h := sha256.Sum256([]byte(kind + "?" + params.Encode()))
+	return kind + ":" + hex.EncodeToString(h[:])
+}
+
+// QueryChan runs the query in a separate goroutine and sends the results over
+// the returned channel, which has a buffer size of `buf`. This is for
+// processing the results concurrently in a pipeline.
+//
+// Each result is loaded into a new model created by `factory`, and the key
+// is assigned to it before it is sent.
+//
+// Both channels are closed when the results are exhausted. If an error
+// occurs, or the context is cancelled, the error is sent on the error channel
+// before both channels are closed. Consumers should therefore read the data
+// channel until it is closed, then check the error channel.
+func QueryChan(ctx context.Context, q *datastore.Query, factory func() Datastorer,
+	buf int) (<-chan Datastorer, <-chan error) {
+	out := make(chan Datastorer, buf)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(out)
+		for it := q.Run(ctx); ; {
+			m := factory()
+			k, err := it.Next(m)
+			if err == datastore.Done {
+				return
+			}
+			if err != nil {
+				errc <- err
+				return
+			}
+			m.SetKey(k)
+			select {
+			case out <- m:
+			case <-ctx.Done():
+				errc <- ctx.Err()
+				return
+			}
+		}
+	}()
+	return out, errc
+}
+
+// QueryPage runs the query for a page of at most `limit` results starting
+// from `cursor` (which can be empty for the first page), e.g. with the values
+// from PrepPageParams.
+//
+// Each result is loaded into a new model created by `factory`, and the key
+// is assigned to it. The cursor for the next page is returned, which is empty
+// if there are no more results.
+//
+// A `limit` that is not positive (e.g. from an invalid "ipp" parameter) is
+// replaced with the default of 50.
+//
+// An InvalidError is returned if the cursor cannot be decoded.
+func QueryPage(ctx context.Context, q *datastore.Query, limit int, cursor string,
+	factory func() Datastorer) ([]Datastorer, string, error) {
+	if limit <= 0 {
+		limit = defaultPageLimit
+	}
+	q = q.Limit(limit)
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", InvalidError{
+				Msg: fmt.Sprintf("cursor '%v': %v", cursor, err),
+			}
+		}
+		q = q.Start(c)
+	}
+	ms := []Datastorer{}
+	it := q.Run(ctx)
+	for {
+		m := factory()
+		k, err := it.Next(m)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		m.SetKey(k)
+		ms = append(ms, m)
+	}
+	if len(ms) < limit {
+		return ms, "", nil
+	}
+	c, err := it.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return ms, c.String(), nil
+}
+
+// Recover is a middleware that recovers from panics in `next` so that the
+// client receives a structured response instead of a bare error. The panic is
+// logged together with the stack trace, and a 500 Internal Server Error is
+// written with the payload
+//
+//	{"errorCode":"INTERNAL","message":"internal server error"}
+//
+// If ExposeInternalErrors is true, the message is the value of the panic
+// instead.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				ctx := appengine.NewContext(r)
+				log.Criticalf(ctx, "panic: %v\n%s", p, debug.Stack())
+				er := ErrorResponse{
+					ErrorCode: "INTERNAL",
+					Message:   "internal server error",
+				}
+				if ExposeInternalErrors {
+					er.Message = fmt.Sprint(p)
+				}
+				WriteErrorResponse(w, http.StatusInternalServerError, er)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
 // RetrieveEntityByID attempts to retrieve the entity from Memcache before
 // retrieving from the Datastore.
 //
@@ -608,6 +2920,9 @@ func RetrieveEntityByKey(ctx context.Context, key *datastore.Key, m Datastorer)
 //
 // The validity check is performed before the pre-saving operation.
 //
+// If the model is not valid, a ValidityError is returned. Its ErrorResponses
+// method gives one ErrorResponse per validation error.
+//
 // After saving, the key is assigned to m.
 func Save(ctx context.Context, m Datastorer) error {
 	if !IsValid(m) {
@@ -626,6 +2941,21 @@ func Save(ctx context.Context, m Datastorer) error {
 	return nil
 }
 
+// SaveAndCount saves the model with Save and, only if that succeeds,
+// increments the counter with CounterIncrement, e.g. to keep track of the
+// number of entities of a kind.
+//
+// The two operations are not atomic as the counter uses its own
+// transactions. If the counter cannot be incremented, the error is returned
+// but the entity remains saved, in which case the counter has to be
+// corrected separately (e.g. with CounterIncrement).
+func SaveAndCount(ctx context.Context, m Datastorer, counterName string) error {
+	if err := Save(ctx, m); err != nil {
+		return err
+	}
+	return CounterIncrement(ctx, counterName)
+}
+
 // SaveCacheEntity saves and caches the entity.
 //
 // The operation to save the entity to the Datastore is performed first. If
@@ -633,6 +2963,9 @@ func Save(ctx context.Context, m Datastorer) error {
 //
 // After saving the entity, it is then put into Memcache. Any error from
 // Memcache is ignored.
+//
+// If m implements CacheInvalidator, the items with its related cache keys are
+// removed from Memcache.
 func SaveCacheEntity(ctx context.Context, m Datastorer) error {
 	if err := Save(ctx, m); err != nil {
 		return err
@@ -644,19 +2977,480 @@ func SaveCacheEntity(ctx context.Context, m Datastorer) error {
 		}
 		memcache.Set(ctx, item) //ignore any error
 	}
+	evictRelated(ctx, m)
+	return nil
+}
+
+// SaveConcurrent saves a large number of models to the Datastore by
+// splitting them into batches of `batchSize` (at most 500, which is the limit
+// of `datastore.PutMulti`) and saving up to `parallelism` batches at the same
+// time.
+//
+// All the models are validated before any of them is saved, and nothing is
+// saved if any of them is invalid. The Presave method of each model is then
+// invoked as in Save, and the keys are assigned to the models after saving.
+//
+// The error returned is an `appengine.MultiError` whose elements correspond
+// to `ms`, with nil for those that were saved successfully (or, in the case
+// of a validation failure, those that are valid).
+func SaveConcurrent(ctx context.Context, ms []Datastorer, batchSize,
+	parallelism int) error {
+	if batchSize <= 0 || batchSize > 500 {
+		batchSize = 500
+	}
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+	merr := make(appengine.MultiError, len(ms))
+	failed := false
+	for i, m := range ms {
+		if !IsValid(m) {
+			merr[i] = ValidityError{
+				Msg: strings.Join(m.ValidationError(), ", "),
+			}
+			failed = true
+		}
+	}
+	if failed {
+		return merr
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sem := make(chan struct{}, parallelism)
+	for start := 0; start < len(ms); start += batchSize {
+		end := start + batchSize
+		if end > len(ms) {
+			end = len(ms)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(start int, batch []Datastorer) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			keys := make([]*datastore.Key, len(batch))
+			for i, m := range batch {
+				if presaver, ok := m.(Presaver); ok {
+					presaver.Presave()
+				}
+				keys[i] = m.MakeKey(ctx)
+			}
+			keys, err := datastore.PutMulti(ctx, keys, batch)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failed = true
+				me, ok := err.(appengine.MultiError)
+				for i := range batch {
+					if ok {
+						merr[start+i] = me[i]
+					} else {
+						merr[start+i] = err
+					}
+				}
+				return
+			}
+			for i, m := range batch {
+				m.SetKey(keys[i])
+			}
+		}(start, ms[start:end])
+	}
+	wg.Wait()
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+// SaveIfChanged saves the model to the Datastore only if it differs from the
+// entity that is already stored, returning true if the model was saved.
+//
+// The validity check and pre-saving operation are performed as in Save. The
+// model is then compared with the stored entity using EntitiesEqual. If the
+// key of the model is incomplete or the entity does not exist yet, the model
+// is always saved.
+//
+// The key is assigned to m whether or not it was saved. The model must be a
+// pointer to a struct.
+func SaveIfChanged(ctx context.Context, m Datastorer) (bool, error) {
+	if !IsValid(m) {
+		return false, ValidityError{
+			Msg: strings.Join(m.ValidationError(), ", "),
+		}
+	}
+	if presaver, ok := m.(Presaver); ok {
+		presaver.Presave()
+	}
+	key := m.MakeKey(ctx)
+	if !key.Incomplete() {
+		t := reflect.Indirect(reflect.ValueOf(m)).Type()
+		stored, ok := reflect.New(t).Interface().(Datastorer)
+		if !ok {
+			return false, TypeError{
+				Name:  t.String(),
+				Cause: "not a pointer to a struct",
+			}
+		}
+		err := datastore.Get(ctx, key, stored)
+		if err == nil && EntitiesEqual(m, stored) {
+			m.SetKey(key)
+			return false, nil
+		}
+		if _, mismatch := err.(*datastore.ErrFieldMismatch); err != nil &&
+			err != datastore.ErrNoSuchEntity && !mismatch {
+			return false, err
+		}
+	}
+	key, err := datastore.Put(ctx, key, m)
+	if err != nil {
+		return false, err
+	}
+	m.SetKey(key)
+	return true, nil
+}
+
+// SaveNormalizedUTC converts all the DateTime fields of the model to UTC
+// before saving it with Save.
+//
+// While DateTime.Equal takes timezone differences into account, the values
+// of a query filter are compared as they are stored. Storing every DateTime
+// in UTC keeps range queries and the values read back consistent regardless
+// of the timezone of the request that saved the entity.
+//
+// Fields of type DateTime and *DateTime are converted, including those in
+// nested structs and slices. The model must be a pointer to a struct.
+func SaveNormalizedUTC(ctx context.Context, m Datastorer) error {
+	normalizeUTC(reflect.ValueOf(m))
+	return Save(ctx, m)
+}
+
+// ServeList handles a typical list request end to end. It gets the
+// pagination parameters from the request with PrepPageParams, runs the query
+// with QueryPage, and writes the results with WriteJSONColl, including the
+// cursor for the next page in the HeaderCursor header.
+//
+// The cursor in the header is signed with SignCursor so that it is rejected
+// (with an InvalidError) if it is used with a different path or filters. The
+// page size ("ipp") can differ between pages. An invalid or non-positive page
+// size is replaced with the default of 50.
+//
+// If there is an error, nothing is written to the response so that the
+// caller can decide how to report it, e.g.
+//
+//	if err := ServeList(w, r, q, factory); err != nil {
+//		WriteResult(w, 0, nil, err)
+//	}
+func ServeList(w http.ResponseWriter, r *http.Request, q *datastore.Query,
+	factory func() Datastorer) error {
+	ctx := appengine.NewContext(r)
+	params := r.URL.Query()
+	limit, cursor := PrepPageParams(params)
+	//bind the cursor to the path and the filters, but not the page size
+	filters := url.Values{}
+	for k, v := range params {
+		if k != "cursor" && k != "ipp" {
+			filters[k] = v
+		}
+	}
+	queryKey := QueryCacheKey(r.URL.Path, filters)
+	if cursor != "" {
+		c, err := VerifyCursor(queryKey, cursor)
+		if err != nil {
+			return err
+		}
+		cursor = c
+	}
+	ms, next, err := QueryPage(ctx, q, limit, cursor, factory)
+	if err != nil {
+		return err
+	}
+	if next != "" {
+		next = SignCursor(queryKey, next)
+	}
+	WriteJSONColl(w, ms, http.StatusOK, next)
+	return nil
+}
+
+// SignCursor binds the cursor to a query by appending a signature of the
+// cursor and `queryKey`, which identifies the query (e.g. from
+// QueryCacheKey). VerifyCursor rejects the signed cursor if it is used with a
+// different query, which would otherwise produce wrong results silently.
+//
+// The signature is an HMAC-SHA256 using PageTokenSecret. If it is not set,
+// the cursor is still bound to the query but the signature can be forged.
+func SignCursor(queryKey, cursor string) string {
+	return cursor + "." + base64.RawURLEncoding.EncodeToString(signCursor(queryKey, cursor))
+}
+
+// SortEntities sorts a slice of Datastorer in place by the value of the named
+// field. The sort is stable, i.e. entities with equal values keep their
+// original order.
+//
+// The field must be an exported field of the underlying struct of type
+// string, any of the int types, or DateTime. A TypeError is returned if the
+// field does not exist or is of any other type, in which case the slice is
+// left untouched.
+//
+// This is meant for sorting small sets of entities in memory. Use the order
+// of a Datastore query for anything larger.
+func SortEntities(ms []Datastorer, field string, asc bool) error {
+	es := &entitySorter{
+		ms:   ms,
+		vals: make([]reflect.Value, len(ms)),
+	}
+	var ft reflect.Type
+	for i, m := range ms {
+		v := reflect.Indirect(reflect.ValueOf(m))
+		if v.Kind() != reflect.Struct {
+			return TypeError{
+				Name:  field,
+				Cause: fmt.Sprintf("%T is not a struct", m),
+			}
+		}
+		sf, ok := v.Type().FieldByName(field)
+		if !ok || sf.PkgPath != "" {
+			return TypeError{
+				Name:  field,
+				Cause: fmt.Sprintf("no exported field in %T", m),
+			}
+		}
+		if ft == nil {
+			ft = sf.Type
+		} else if ft != sf.Type {
+			return TypeError{
+				Name:  field,
+				Cause: fmt.Sprintf("mixed types %v and %v", ft, sf.Type),
+			}
+		}
+		es.vals[i] = v.FieldByIndex(sf.Index)
+	}
+	if ft == nil {
+		return nil
+	}
+	switch ft.Kind() {
+	case reflect.String:
+		es.less = func(a, b reflect.Value) bool {
+			return a.String() < b.String()
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		es.less = func(a, b reflect.Value) bool {
+			return a.Int() < b.Int()
+		}
+	default:
+		if ft != reflect.TypeOf(DateTime{}) {
+			return TypeError{
+				Name:  field,
+				Cause: fmt.Sprintf("unsupported type %v", ft),
+			}
+		}
+		es.less = func(a, b reflect.Value) bool {
+			return a.Interface().(DateTime).Time.Before(b.Interface().(DateTime).Time)
+		}
+	}
+	if !asc {
+		less := es.less
+		es.less = func(a, b reflect.Value) bool {
+			return less(b, a)
+		}
+	}
+	sort.Stable(es)
+	return nil
+}
+
+// Timed runs f and logs how long it took, together with the operation name.
+// The error returned by f is returned as is, e.g.
+//
+//	err := Timed(ctx, "load-orders", func() error {
+//		return LoadByID(ctx, id, &order)
+//	})
+func Timed(ctx context.Context, name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	d := time.Since(start)
+	log.Debugf(ctx, "%v took %v", name, d)
+	if TimedHook != nil {
+		TimedHook(name, d)
+	}
+	return err
+}
+
+// ValidateOrder checks that `earlier` is not after `later`, ignoring
+// sub-second differences. Equal timestamps are considered to be in order.
+//
+// A ValidityError naming `fieldName` (which should be the field holding
+// `later`) is returned if they are out of order. This is meant to be used in
+// the ValidationError method of models, e.g. to ensure that the end of a
+// booking is not before its start.
+func ValidateOrder(earlier, later DateTime, fieldName string) error {
+	if earlier.After(later) {
+		return ValidityError{
+			Msg: fmt.Sprintf("%v (%v) must not be before %v",
+				fieldName, later.String(), earlier.String()),
+		}
+	}
 	return nil
 }
 
+// ValidatePartial returns the validation errors of the specified fields of
+// the model.
+//
+// If m implements PartialValidator, its ValidationErrorFor method is used.
+// Otherwise all the fields are validated using its ValidationError method.
+func ValidatePartial(m Datastorer, fields []string) []string {
+	if pv, ok := m.(PartialValidator); ok {
+		return pv.ValidationErrorFor(fields)
+	}
+	return m.ValidationError()
+}
+
+// ValidationErrorResponses returns one ErrorResponse for each of the
+// validation errors of the model (from its ValidationError method), with the
+// error code VALIDATION, so that the errors can be returned to API clients
+// individually, e.g. with WriteErrorResponseList.
+//
+// An empty slice is returned if the model is valid.
+func ValidationErrorResponses(m Datastorer) []ErrorResponse {
+	msgs := m.ValidationError()
+	ers := make([]ErrorResponse, len(msgs))
+	for i, msg := range msgs {
+		ers[i] = ErrorResponse{
+			ErrorCode: "VALIDATION",
+			Message:   msg,
+		}
+	}
+	return ers
+}
+
+// VerifyCursor checks that the cursor signed with SignCursor belongs to the
+// query identified by `queryKey`, and returns the original cursor.
+//
+// An InvalidError is returned if the signed cursor is malformed or belongs
+// to a different query.
+func VerifyCursor(queryKey, signed string) (string, error) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", InvalidError{
+			Msg: "cursor is not signed",
+		}
+	}
+	cursor := signed[:i]
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil || !hmac.Equal(sig, signCursor(queryKey, cursor)) {
+		return "", InvalidError{
+			Msg: "cursor does not belong to the query",
+		}
+	}
+	return cursor, nil
+}
+
+// evictRelated removes the related items of the model from memcache if it
+// implements CacheInvalidator.
+func evictRelated(ctx context.Context, m Datastorer) {
+	if ci, ok := m.(CacheInvalidator); ok {
+		if keys := ci.RelatedCacheKeys(); len(keys) > 0 {
+			memcache.DeleteMulti(ctx, keys) //ignore any error
+		}
+	}
+}
+
+// normalizeUTC converts the DateTime values in v to UTC, descending into
+// pointers, structs and slices.
+func normalizeUTC(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			normalizeUTC(v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			normalizeUTC(v.Index(i))
+		}
+	case reflect.Struct:
+		if d, ok := v.Interface().(DateTime); ok {
+			if v.CanSet() {
+				v.Set(reflect.ValueOf(d.UTC()))
+			}
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).PkgPath == "" { //exported
+				normalizeUTC(v.Field(i))
+			}
+		}
+	}
+}
+
+// saveProperties gets the properties of the model as they would be stored in
+// the Datastore.
+func saveProperties(m Datastorer) ([]datastore.Property, error) {
+	if pls, ok := m.(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	return datastore.SaveStruct(m)
+}
+
+// signCursor computes the signature of the cursor for the query using
+// PageTokenSecret.
+func signCursor(queryKey, cursor string) []byte {
+	mac := hmac.New(sha256.New, PageTokenSecret)
+	mac.Write([]byte(queryKey + "\n" + cursor))
+	return mac.Sum(nil)
+}
+
+// signPageToken computes the signature of the page token payload using
+// PageTokenSecret.
+func signPageToken(payload []byte) []byte {
+	mac := hmac.New(sha256.New, PageTokenSecret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// WriteError writes the error response with WriteErrorResponse using its
+// StatusCode, or 500 Internal Server Error if it is not set. The HeaderError
+// header is set to the error string of the response (see
+// ErrorResponse.Error).
+func WriteError(w http.ResponseWriter, er ErrorResponse) {
+	code := er.StatusCode
+	if code == 0 {
+		code = http.StatusInternalServerError
+	}
+	w.Header().Set(http.CanonicalHeaderKey(HeaderError), er.Error())
+	WriteErrorResponse(w, code, er)
+}
+
 // WriteErrorResponse writes an error response along with a payload that
 // provides more information about the error for the client.
+//
+// If the payload cannot be marshalled (e.g. because of a value in Details), a
+// 500 Internal Server Error is written instead with an empty body and the
+// error in the HeaderError header.
 func WriteErrorResponse(w http.ResponseWriter, code int, er ErrorResponse) {
 	j, e := json.Marshal(er)
 	if e != nil {
 		w.Header().Set(http.CanonicalHeaderKey(HeaderError), e.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 	w.Header().Set(http.CanonicalHeaderKey("Content-Type"), "application/json")
 	w.WriteHeader(code)
-	fmt.Fprintf(w, string(j))
+	w.Write(j)
+}
+
+// WriteErrorResponseList writes an error response with all of the errors in
+// the list as a JSON array, e.g. the validation errors of every field in a
+// form.
+//
+// If the list cannot be marshalled, a 500 Internal Server Error is written
+// instead with the error in the HeaderError header.
+func WriteErrorResponseList(w http.ResponseWriter, code int, list ErrorResponseList) {
+	j, e := json.Marshal(list)
+	if e != nil {
+		w.Header().Set(http.CanonicalHeaderKey(HeaderError), e.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(http.CanonicalHeaderKey("Content-Type"), "application/json")
+	w.WriteHeader(code)
+	w.Write(j)
 }
 
 // WriteJSON writes an instance of Datastorer as a JSON string into the response
@@ -687,9 +3481,14 @@ func WriteJSON(w http.ResponseWriter, m Datastorer, status int) {
 //		coll[k] = &v
 //	}
 //
+// A nil slice is written as an empty JSON array ("[]") instead of "null".
+//
 // If there is any error writing the JSON, a 500 Internal Server error is
 // returned.
 func WriteJSONColl(w http.ResponseWriter, m []Datastorer, status int, cursor string) {
+	if m == nil {
+		m = []Datastorer{}
+	}
 	j, e := json.Marshal(m)
 	if e != nil {
 		WriteRespErr(w, http.StatusInternalServerError, e)
@@ -711,6 +3510,21 @@ func WriteLogRespErr(c context.Context, w http.ResponseWriter, code int, e error
 	w.WriteHeader(code)
 }
 
+// WriteMethodNotAllowed writes a 405 Method Not Allowed response with the
+// "Allow" header listing the allowed methods, e.g.
+//
+//	WriteMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+//
+// The payload is an ErrorResponse with the error code "METHOD_NOT_ALLOWED".
+func WriteMethodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	methods := strings.Join(allowed, ", ")
+	w.Header().Set(http.CanonicalHeaderKey("Allow"), methods)
+	WriteErrorResponse(w, http.StatusMethodNotAllowed, ErrorResponse{
+		ErrorCode: "METHOD_NOT_ALLOWED",
+		Message:   "method not allowed; allowed methods: " + methods,
+	})
+}
+
 // WriteRespErr writes the error string to the response header (HeaderError)
 // before setting the response code.
 func WriteRespErr(w http.ResponseWriter, code int, e error) {
@@ -719,3 +3533,55 @@ func WriteRespErr(w http.ResponseWriter, code int, e error) {
 	}
 	w.WriteHeader(code)
 }
+
+// WriteResult writes a uniform JSON envelope into the response body.
+//
+// If `err` is nil, the payload is
+//
+//	{"data": <data>}
+//
+// and the status code is set to `status`. Otherwise the payload is
+//
+//	{"error": <ErrorResponse>}
+//
+// and the status code is derived from the type of the error (see
+// `StatusForError`). An ErrorResponseList is written as is, i.e. the value of
+// "error" is an array. If `err` is neither of these, its error string is used
+// as the Message of the ErrorResponse. For a 500 Internal Server Error,
+// the error string is only used if ExposeInternalErrors is true. Otherwise
+// the ErrorResponse has the error code INTERNAL and a generic message, like
+// the one written by Recover, so that internal details are not leaked.
+//
+// If there is any error writing the JSON, a 500 Internal Server error is
+// returned.
+func WriteResult(w http.ResponseWriter, status int, data interface{}, err error) {
+	payload := make(map[string]interface{})
+	if err != nil {
+		status = StatusForError(err)
+		switch err.(type) {
+		case ErrorResponse, ErrorResponseList:
+			payload["error"] = err
+		default:
+			er := ErrorResponse{
+				Message: err.Error(),
+			}
+			if status == http.StatusInternalServerError {
+				er.ErrorCode = "INTERNAL"
+				if !ExposeInternalErrors {
+					er.Message = "internal server error"
+				}
+			}
+			payload["error"] = er
+		}
+	} else {
+		payload["data"] = data
+	}
+	j, e := json.Marshal(payload)
+	if e != nil {
+		WriteRespErr(w, http.StatusInternalServerError, e)
+		return
+	}
+	w.Header().Set(http.CanonicalHeaderKey("Content-Type"), "application/json")
+	w.WriteHeader(status)
+	w.Write(j)
+}
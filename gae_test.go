@@ -1,12 +1,17 @@
 package gae
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -53,7 +58,7 @@ func (this *Ointment) MakeKey(ctx context.Context) *datastore.Key {
 
 func (this *Ointment) Presave() {
 	if !this.Expiry.IsZero() {
-		this.Expiry = DateTime{this.Expiry.AddDate(0, -1, 0)}
+		this.Expiry = this.Expiry.AddDate(0, -1, 0)
 	}
 }
 
@@ -396,6 +401,15 @@ func TestDateTime(t *testing.T) {
 		t.Errorf("expect time to be zeroed; got %v", t1a)
 	}
 
+	//unmarshalling empty quotes resets a non-zero time
+	t1d := NewDateTimeNow()
+	if err := t1d.UnmarshalJSON(([]byte)(`""`)); err != nil {
+		t.Errorf("error unmarshalling time from empty quotes \"\": %v", err)
+	}
+	if !t1d.IsZero() {
+		t.Errorf("expect non-zero time to be zeroed; got %v", t1d)
+	}
+
 	t2 := DateTime{time.Now()}
 	if t1.Equal(t2) {
 		t.Errorf("t1 (%v) should not be equal to t2 (%v)", t1, t2)
@@ -457,6 +471,554 @@ func TestDateTime(t *testing.T) {
 	}
 }
 
+func TestDateTimeProto(t *testing.T) {
+	d1, _ := NewDateTime("2017-07-03T09:44:00+08:00")
+	ts := d1.ToProtoTimestamp()
+	if ts == nil {
+		t.Fatal("expect ToProtoTimestamp to return a timestamp; got nil")
+	}
+	if want := d1.Unix(); want != ts.Seconds {
+		t.Errorf("expect timestamp seconds %d; got %d", want, ts.Seconds)
+	}
+	d2 := DateTimeFromProto(ts)
+	if !d1.Equal(d2) {
+		t.Errorf("expect round-tripped time %v; got %v", d1, d2)
+	}
+
+	if ts := (DateTime{}).ToProtoTimestamp(); ts != nil {
+		t.Errorf("expect zeroed DateTime to convert to nil; got %v", ts)
+	}
+	if d := DateTimeFromProto(nil); !d.IsZero() {
+		t.Errorf("expect nil timestamp to convert to zeroed DateTime; got %v", d)
+	}
+}
+
+func TestDateTimeMillis(t *testing.T) {
+	sgt, _ := time.LoadLocation("Asia/Singapore")
+	d1 := DateTimeMillis{time.Date(2007, 06, 05, 16, 03, 02, 123456789, sgt)}
+	j1, err := d1.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"2007-06-05T16:03:02.123+08:00"`
+	if want != string(j1) {
+		t.Errorf("expect JSON time %v; got %v", want, string(j1))
+	}
+	d2 := DateTimeMillis{}
+	if e := d2.UnmarshalJSON(j1); e != nil {
+		t.Fatal(e)
+	}
+	if !d1.Equal(d2) {
+		t.Errorf("expect round-tripped time %v; got %v", d1.String(), d2.String())
+	}
+	if d2.Nanosecond() != 123000000 {
+		t.Errorf("expect milliseconds to be kept; got %d ns", d2.Nanosecond())
+	}
+	d3 := DateTimeMillis{d1.Add(time.Millisecond)}
+	if d1.Equal(d3) {
+		t.Errorf("expect %v and %v to be different", d1.String(), d3.String())
+	}
+	d4 := DateTimeMillis{d1.In(time.UTC)}
+	if !d1.Equal(d4) {
+		t.Errorf("expect %v and %v to be equal", d1.String(), d4.String())
+	}
+
+	//empty string
+	d5 := DateTimeMillis{}
+	if j, _ := d5.MarshalJSON(); string(j) != `""` {
+		t.Errorf("expect empty string for zeroed time; got %v", string(j))
+	}
+	if e := d2.UnmarshalJSON([]byte(`""`)); e != nil || !d2.IsZero() {
+		t.Errorf("expect time to be zeroed; got %v (%v)", d2.String(), e)
+	}
+	if e := d2.UnmarshalJSON([]byte(`"2007-06-05"`)); e == nil {
+		t.Error("expect error for invalid timestamp; got nil")
+	}
+}
+
+func TestDateTimeWeek(t *testing.T) {
+	sgt, _ := time.LoadLocation("Asia/Singapore")
+	cases := []struct {
+		title     string
+		tstamp    string
+		loc       *time.Location
+		wantYear  int
+		wantWeek  int
+		wantStart string
+	}{
+		{
+			title:     "Sunday night",
+			tstamp:    "2017-07-09T23:59:59+08:00",
+			loc:       sgt,
+			wantYear:  2017,
+			wantWeek:  27,
+			wantStart: "2017-07-03T00:00:00+08:00",
+		},
+		{
+			title:     "Monday midnight",
+			tstamp:    "2017-07-10T00:00:00+08:00",
+			loc:       sgt,
+			wantYear:  2017,
+			wantWeek:  28,
+			wantStart: "2017-07-10T00:00:00+08:00",
+		},
+		{
+			title:     "Sunday in UTC is Monday in Singapore",
+			tstamp:    "2017-07-09T20:00:00Z",
+			loc:       sgt,
+			wantYear:  2017,
+			wantWeek:  27,
+			wantStart: "2017-07-10T00:00:00+08:00",
+		},
+		{
+			title:     "Own location",
+			tstamp:    "2017-07-09T20:00:00Z",
+			wantYear:  2017,
+			wantWeek:  27,
+			wantStart: "2017-07-03T00:00:00Z",
+		},
+		{
+			title:     "ISO year differs from calendar year",
+			tstamp:    "2017-01-01T12:00:00+08:00",
+			loc:       sgt,
+			wantYear:  2016,
+			wantWeek:  52,
+			wantStart: "2016-12-26T00:00:00+08:00",
+		},
+	}
+	for _, c := range cases {
+		d, err := NewDateTime(c.tstamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		year, week := d.ISOWeek()
+		if c.wantYear != year || c.wantWeek != week {
+			t.Errorf("%v: expect ISO week %d-%d; got %d-%d",
+				c.title, c.wantYear, c.wantWeek, year, week)
+		}
+		start := d.StartOfWeek(c.loc)
+		if got := start.String(); c.wantStart != got {
+			t.Errorf("%v: expect start of week %v; got %v", c.title, c.wantStart, got)
+		}
+	}
+}
+
+func TestNewDateTimeFrom(t *testing.T) {
+	layouts := []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05Z07:00"}
+	cases := []struct {
+		tstamp  string
+		layouts []string
+		want    string
+		wantErr bool
+	}{
+		{"2016-05-04T13:22:31+08:00", nil, "2016-05-04T13:22:31+08:00", false},
+		{"2016-05-04T13:22:31", nil, "", true},
+		{"2016-05-04T13:22:31+08:00", layouts, "2016-05-04T13:22:31+08:00", false},
+		{"2016-05-04T13:22:31", layouts, "2016-05-04T13:22:31Z", false},
+		{"2016-05-04 13:22:31+08:00", layouts, "2016-05-04T13:22:31+08:00", false},
+		{"04/05/2016", layouts, "", true},
+	}
+	for _, c := range cases {
+		d, err := NewDateTimeFrom(c.tstamp, c.layouts...)
+		if c.wantErr {
+			if !IsInvalidError(err) {
+				t.Errorf("%v: expect InvalidError; got %v", c.tstamp, err)
+			} else if len(c.layouts) > 0 && !strings.Contains(err.Error(), c.layouts[1]) {
+				t.Errorf("%v: expect error to list the layouts; got %v", c.tstamp, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: expect no error; got %v", c.tstamp, err)
+			continue
+		}
+		if got := d.String(); c.want != got {
+			t.Errorf("%v: expect %v; got %v", c.tstamp, c.want, got)
+		}
+	}
+}
+
+func TestDateTimeBeforeAfter(t *testing.T) {
+	sgt, _ := time.LoadLocation("Asia/Singapore")
+	base := time.Date(2017, time.July, 3, 17, 59, 59, 0, sgt)
+	cases := []struct {
+		title      string
+		d1         DateTime
+		d2         DateTime
+		wantBefore bool
+		wantAfter  bool
+	}{
+		{
+			title:      "Earlier",
+			d1:         DateTime{base},
+			d2:         DateTime{base.Add(time.Second)},
+			wantBefore: true,
+		},
+		{
+			title:     "Later",
+			d1:        DateTime{base.Add(time.Second)},
+			d2:        DateTime{base},
+			wantAfter: true,
+		},
+		{
+			title: "Same instant, different timezone",
+			d1:    DateTime{base},
+			d2:    DateTime{base.UTC()},
+		},
+		{
+			title: "Sub-second difference, different timezone",
+			d1:    DateTime{base.Add(999 * time.Millisecond)},
+			d2:    DateTime{base.UTC()},
+		},
+		{
+			title:      "Earlier local time is later instant",
+			d1:         DateTime{time.Date(2017, time.July, 3, 10, 0, 0, 0, time.UTC)},
+			d2:         DateTime{time.Date(2017, time.July, 3, 17, 0, 0, 0, sgt)},
+			wantBefore: false,
+			wantAfter:  true,
+		},
+	}
+	for _, c := range cases {
+		if got := c.d1.Before(c.d2); c.wantBefore != got {
+			t.Errorf("%v: expect Before to return %v; got %v", c.title, c.wantBefore, got)
+		}
+		if got := c.d1.After(c.d2); c.wantAfter != got {
+			t.Errorf("%v: expect After to return %v; got %v", c.title, c.wantAfter, got)
+		}
+	}
+
+	//non-addressable values
+	if !DateTimeFromUnix(1).Before(DateTimeFromUnix(2)) {
+		t.Error("expect DateTimeFromUnix(1) to be before DateTimeFromUnix(2)")
+	}
+	if !DateTimeFromUnix(2).After(DateTimeFromUnix(1)) {
+		t.Error("expect DateTimeFromUnix(2) to be after DateTimeFromUnix(1)")
+	}
+}
+
+func TestDateTimeText(t *testing.T) {
+	d1, _ := NewDateTime("2017-07-03T09:44:00+08:00")
+	txt, err := d1.MarshalText()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2017-07-03T09:44:00+08:00"; want != string(txt) {
+		t.Errorf("expect text %v; got %v", want, string(txt))
+	}
+	d2 := NewDateTimeNow()
+	if e := d2.UnmarshalText(txt); e != nil {
+		t.Fatal(e)
+	}
+	if !d1.Equal(d2) {
+		t.Errorf("expect round-tripped time %v; got %v", d1, d2)
+	}
+
+	//empty string round trip
+	txt, err = DateTime{}.MarshalText()
+	if err != nil || len(txt) != 0 {
+		t.Errorf("expect empty text for zeroed time; got '%v' (%v)", string(txt), err)
+	}
+	if e := d2.UnmarshalText(txt); e != nil || !d2.IsZero() {
+		t.Errorf("expect time to be zeroed; got %v (%v)", d2, e)
+	}
+	if e := d2.UnmarshalText([]byte("2017-07-03")); e == nil {
+		t.Error("expect error for invalid timestamp; got nil")
+	}
+
+	//as map keys
+	m1 := map[DateTime]int{d1: 1}
+	j, err := json.Marshal(m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"2017-07-03T09:44:00+08:00":1}`; want != string(j) {
+		t.Errorf("expect JSON %v; got %v", want, string(j))
+	}
+	m2 := make(map[DateTime]int)
+	if e := json.Unmarshal(j, &m2); e != nil {
+		t.Fatal(e)
+	}
+	for k, v := range m2 {
+		if !d1.Equal(k) || v != 1 {
+			t.Errorf("expect map entry %v: 1; got %v: %d", d1, k, v)
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	d1, err := NewDate("2016-05-04")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := d1.String(); got != "2016-05-04" {
+		t.Errorf("expect date string 2016-05-04; got %v", got)
+	}
+	j, err := d1.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(j) != `"2016-05-04"` {
+		t.Errorf("expect JSON date \"2016-05-04\"; got %v", string(j))
+	}
+	d2 := Date{}
+	if e := d2.UnmarshalJSON(j); e != nil {
+		t.Fatal(e)
+	}
+	if !d1.Equal(d2) {
+		t.Errorf("expect round-tripped date %v; got %v", d1.String(), d2.String())
+	}
+
+	//time of day is ignored
+	d3 := Date{d1.Add(23 * time.Hour)}
+	if !d1.Equal(d3) {
+		t.Errorf("expect %v and %v to be the same date", d1.Time, d3.Time)
+	}
+	d4 := Date{d1.AddDate(0, 0, 1)}
+	if d1.Equal(d4) {
+		t.Errorf("expect %v and %v to be different dates", d1.String(), d4.String())
+	}
+
+	//empty string
+	if j, _ := (&Date{}).MarshalJSON(); string(j) != `""` {
+		t.Errorf("expect empty string for zeroed date; got %v", string(j))
+	}
+	if e := d2.UnmarshalJSON([]byte(`""`)); e != nil || !d2.IsZero() {
+		t.Errorf("expect date to be zeroed; got %v (%v)", d2.String(), e)
+	}
+
+	//invalid
+	for _, in := range []string{`"2016-05-04T13:22:31+08:00"`, `"2016-13-01"`, `2016`} {
+		if e := d2.UnmarshalJSON([]byte(in)); e == nil {
+			t.Errorf("expect error unmarshalling %v; got nil", in)
+		}
+	}
+	if _, e := NewDate("04/05/2016"); e == nil {
+		t.Error("expect NewDate to return error for invalid format")
+	}
+}
+
+func TestDateStorage(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	type task struct {
+		Due Date
+	}
+	due, _ := NewDate("2016-05-04")
+	k, err := datastore.Put(ctx, datastore.NewIncompleteKey(ctx, "Task", nil),
+		&task{due})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got task
+	if e := datastore.Get(ctx, k, &got); e != nil {
+		t.Fatal(e)
+	}
+	if !due.Equal(got.Due) || got.Due.String() != "2016-05-04" {
+		t.Errorf("expect stored date %v; got %v", due.String(), got.Due.String())
+	}
+}
+
+func TestDateTimeArithmetic(t *testing.T) {
+	d1, _ := NewDateTime("2016-01-31T13:22:31+08:00")
+	cases := []struct {
+		title string
+		got   DateTime
+		want  string
+	}{
+		{"Add 1 day", d1.AddDate(0, 0, 1), "2016-02-01T13:22:31+08:00"},
+		{"Subtract 1 year", d1.AddDate(-1, 0, 0), "2015-01-31T13:22:31+08:00"},
+		{"Add 1 month (normalised)", d1.AddDate(0, 1, 0), "2016-03-02T13:22:31+08:00"},
+		{"Add 90 minutes", d1.AddDuration(90 * time.Minute), "2016-01-31T14:52:31+08:00"},
+		{"Subtract 1 second", d1.AddDuration(-time.Second), "2016-01-31T13:22:30+08:00"},
+	}
+	for _, c := range cases {
+		if got := c.got.String(); c.want != got {
+			t.Errorf("%v: expect %v; got %v", c.title, c.want, got)
+		}
+	}
+	if got := d1.String(); got != "2016-01-31T13:22:31+08:00" {
+		t.Errorf("expect original time to be unchanged; got %v", got)
+	}
+}
+
+func TestDateTimeUnixSeconds(t *testing.T) {
+	cases := []struct {
+		input string
+		want  string
+	}{
+		{`1136214245`, "2006-01-02T15:04:05Z"},
+		{`"2006-01-02T15:04:05+07:00"`, "2006-01-02T15:04:05+07:00"},
+		{`""`, "0001-01-01T00:00:00Z"},
+	}
+	for _, c := range cases {
+		var d DateTime
+		if e := json.Unmarshal([]byte(c.input), &d); e != nil {
+			t.Errorf("expect %v to unmarshal; got error %v", c.input, e)
+			continue
+		}
+		if got := d.String(); c.want != got {
+			t.Errorf("expect %v to unmarshal to %v; got %v", c.input, c.want, got)
+		}
+	}
+
+	var d DateTime
+	if e := json.Unmarshal([]byte(`1.5`), &d); e == nil {
+		t.Error("expect error for fractional seconds")
+	}
+	d, _ = NewDateTime("2006-01-02T22:04:05+07:00")
+	if got := d.UnixSeconds(); got != 1136214245 {
+		t.Errorf("expect 1136214245; got %v", got)
+	}
+}
+
+func TestDateTimeGob(t *testing.T) {
+	type booking struct {
+		Name  string
+		Start DateTime
+		End   DateTime
+	}
+	d1, _ := NewDateTime("2016-01-31T13:22:31+08:00")
+	in := booking{
+		Name:  "Lion",
+		Start: DateTime{d1.Add(500 * time.Millisecond)},
+	}
+	var buf bytes.Buffer
+	if e := gob.NewEncoder(&buf).Encode(in); e != nil {
+		t.Fatal(e)
+	}
+	var out booking
+	if e := gob.NewDecoder(&buf).Decode(&out); e != nil {
+		t.Fatal(e)
+	}
+	if out.Name != in.Name {
+		t.Errorf("expect name %v; got %v", in.Name, out.Name)
+	}
+	if out.Start.String() != d1.String() || out.Start.Nanosecond() != 0 {
+		t.Errorf("expect start %v; got %v", d1.String(), out.Start.Time)
+	}
+	if !out.End.IsZero() {
+		t.Errorf("expect end to be zero; got %v", out.End.Time)
+	}
+}
+
+func TestParseDateTime(t *testing.T) {
+	d, err := ParseDateTime("02 Jan 2006 15:04", "31 Jan 2016 13:22")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "2016-01-31T13:22:00Z"; d.String() != want {
+		t.Errorf("expect %v; got %v", want, d.String())
+	}
+	if _, e := ParseDateTime(DateTimeLayout, "31 Jan 2016 13:22"); e == nil {
+		t.Error("expect error for value not in layout")
+	}
+}
+
+func TestDateTimeUnix(t *testing.T) {
+	d1, _ := NewDateTime("2006-01-02T22:04:05+07:00")
+	if got := d1.Unix(); got != 1136214245 {
+		t.Errorf("expect 1136214245; got %v", got)
+	}
+	d2 := DateTimeFromUnix(1136214245)
+	if !d2.Equal(d1) {
+		t.Errorf("expect %v; got %v", d1.String(), d2.String())
+	}
+	if d2.Location() != time.UTC {
+		t.Errorf("expect time in UTC; got %v", d2.Location())
+	}
+	if got := DateTimeFromUnix(d1.Unix()).Unix(); got != d1.Unix() {
+		t.Errorf("expect round trip to %v; got %v", d1.Unix(), got)
+	}
+	d3 := DateTimeFromUnix(-1)
+	if got := d3.String(); got != "1969-12-31T23:59:59Z" {
+		t.Errorf("expect 1969-12-31T23:59:59Z; got %v", got)
+	}
+}
+
+func TestDateTimeEqualNil(t *testing.T) {
+	var d1 *DateTime
+	if !d1.Equal(DateTime{}) {
+		t.Error("expect nil DateTime to equal zeroed DateTime")
+	}
+	if d1.Equal(NewDateTimeNow()) {
+		t.Error("expect nil DateTime to not equal non-zero DateTime")
+	}
+}
+
+func TestDateTimeEqualWallClock(t *testing.T) {
+	d1, _ := NewDateTime("2006-01-02T22:04:05+07:00")
+	d2, _ := NewDateTime("2006-01-02T15:04:05Z")
+	if !d1.Equal(d2) {
+		t.Errorf("expect %v to equal %v", d1.String(), d2.String())
+	}
+	if d1.EqualWallClock(d2) {
+		t.Errorf("expect %v to not equal %v on the wall clock", d1.String(),
+			d2.String())
+	}
+	d3 := d1.AddDuration(500 * time.Millisecond)
+	if !d1.EqualWallClock(d3) {
+		t.Errorf("expect sub-second differences to be ignored; got %v",
+			d3.String())
+	}
+	d4 := DateTime{d2.In(time.FixedZone("ICT", 7*60*60))}
+	if !d1.EqualWallClock(d4) {
+		t.Errorf("expect %v to equal %v on the wall clock", d1.String(),
+			d4.String())
+	}
+}
+
+func TestCombineDateTime(t *testing.T) {
+	sgt := time.FixedZone("SGT", 8*60*60)
+	cases := []struct {
+		date, time string
+		loc        *time.Location
+		want       string
+		wantErr    bool
+	}{
+		{"2024-07-03", "14:30", sgt, "2024-07-03T14:30:00+08:00", false},
+		{"2024-07-03", "14:30:15", nil, "2024-07-03T14:30:15Z", false},
+		{"2024-07-03", "25:30", sgt, "", true},
+		{"2024-07-03", "2pm", sgt, "", true},
+		{"03/07/2024", "14:30", sgt, "", true},
+	}
+	for _, c := range cases {
+		d, err := CombineDateTime(c.date, c.time, c.loc)
+		if c.wantErr {
+			if !IsInvalidError(err) {
+				t.Errorf("expect InvalidError for %v %v; got %v", c.date, c.time, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expect %v %v to be combined; got error %v", c.date, c.time, err)
+			continue
+		}
+		if got := d.String(); c.want != got {
+			t.Errorf("expect %v; got %v", c.want, got)
+		}
+	}
+}
+
+func TestDateTimeIsSet(t *testing.T) {
+	if ZeroDateTime.IsSet() {
+		t.Error("expect ZeroDateTime to not be set")
+	}
+	if !ZeroDateTime.IsZero() {
+		t.Error("expect ZeroDateTime to be zero")
+	}
+	var d DateTime
+	if d.IsSet() || !d.Equal(ZeroDateTime) {
+		t.Error("expect uninitialised DateTime to not be set")
+	}
+	if d = NewDateTimeNow(); !d.IsSet() {
+		t.Error("expect current time to be set")
+	}
+}
+
 func TestCoverage(t *testing.T) {
 	ctx, done, err := aetest.NewContext()
 	if err != nil {
@@ -502,7 +1064,7 @@ func TestCoverageCounter(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	mkey := counterMemcacheKey("c1")
+	mkey := counterMemcacheKey(ctx, "c1")
 	err = memcache.JSON.Set(ctx, &memcache.Item{
 		Key:    mkey,
 		Object: 33,
@@ -1052,34 +1614,129 @@ func TestErrorResponseEqual(t *testing.T) {
 	}
 }
 
-func TestErrorResponseError(t *testing.T) {
-	ec := "SESSION_ERROR"
-	field := "userID"
-	msg := "user not authorized"
-	value := "guest"
+func TestErrorResponseDetails(t *testing.T) {
+	er := ErrorResponse{ErrorCode: "TOO_SHORT", Field: "password"}
+	j, err := json.Marshal(er)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(j), "details") {
+		t.Errorf("expect details to be omitted; got %s", j)
+	}
+
+	e1 := er
+	e1.Details = map[string]interface{}{"minLength": 8, "rules": []string{"digit"}}
+	e2 := er
+	e2.Details = map[string]interface{}{"minLength": 8, "rules": []string{"digit"}}
+	if !e1.Equal(e2) {
+		t.Error("expect instances with the same details to be equal")
+	}
+	if e1.Equal(er) {
+		t.Error("expect instances with and without details to be NOT equal")
+	}
+	e2.Details["minLength"] = 10
+	if e1.Equal(e2) {
+		t.Error("expect instances with different details to be NOT equal")
+	}
+	if e1.Error() != er.Error() {
+		t.Errorf("expect details to be excluded from %v; got %v", er.Error(),
+			e1.Error())
+	}
+
+	rec := httptest.NewRecorder()
+	WriteErrorResponse(rec, 400, e1)
+	var resp ErrorResponse
+	if e := json.Unmarshal(rec.Body.Bytes(), &resp); e != nil {
+		t.Fatal(e)
+	}
+	if v, ok := resp.Details["minLength"].(float64); !ok || v != 8 {
+		t.Errorf("expect minLength 8 in details; got %v", resp.Details)
+	}
+}
 
+func TestWriteError(t *testing.T) {
 	cases := []struct {
-		output string
-		er     ErrorResponse
+		er       ErrorResponse
+		wantCode int
 	}{
 		{
-			output: "user not authorized (SESSION_ERROR) - userID(guest)",
-			er: ErrorResponse{
-				ErrorCode:     ec,
-				Field:         field,
-				Message:       msg,
-				OriginalValue: value,
-			},
+			er:       ErrorResponse{ErrorCode: "INTERNAL", Message: "database unavailable"},
+			wantCode: http.StatusInternalServerError,
 		},
 		{
-			output: "user not authorized - userID(guest)",
-			er: ErrorResponse{
-				Field:         field,
-				Message:       msg,
-				OriginalValue: value,
-			},
+			er: ErrorResponse{ErrorCode: "BAD_FORMAT", Field: "email",
+				StatusCode: http.StatusBadRequest},
+			wantCode: http.StatusBadRequest,
 		},
-		{
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		WriteError(w, c.er)
+		if w.Code != c.wantCode {
+			t.Errorf("expect status %d; got %d", c.wantCode, w.Code)
+		}
+		if h := w.Header().Get(HeaderError); h != c.er.Error() {
+			t.Errorf("expect %v header %q; got %q", HeaderError, c.er.Error(), h)
+		}
+		if strings.Contains(w.Body.String(), "tatusCode") {
+			t.Errorf("expect status code to be omitted; got %v", w.Body.String())
+		}
+		var got ErrorResponse
+		if e := json.Unmarshal(w.Body.Bytes(), &got); e != nil {
+			t.Fatal(e)
+		}
+		if !c.er.Equal(got) {
+			t.Errorf("expect %v; got %v", c.er, got)
+		}
+	}
+}
+
+func TestErrorResponseBuilder(t *testing.T) {
+	got := NewErrorResponse().Code("BAD_FORMAT").Field("email").
+		Msg("invalid email").Original("a@b@c").Help("/help/email").Build()
+	want := ErrorResponse{
+		ErrorCode:     "BAD_FORMAT",
+		Field:         "email",
+		HelpURL:       "/help/email",
+		Message:       "invalid email",
+		OriginalValue: "a@b@c",
+	}
+	if !want.Equal(got) {
+		t.Errorf("expect %+v; got %+v", want, got)
+	}
+	if got := NewErrorResponse().Msg("oops").Build(); !got.Equal(ErrorResponse{Message: "oops"}) {
+		t.Errorf("expect only the message to be set; got %+v", got)
+	}
+}
+
+func TestErrorResponseError(t *testing.T) {
+	ec := "SESSION_ERROR"
+	field := "userID"
+	msg := "user not authorized"
+	value := "guest"
+
+	cases := []struct {
+		output string
+		er     ErrorResponse
+	}{
+		{
+			output: "user not authorized (SESSION_ERROR) - userID(guest)",
+			er: ErrorResponse{
+				ErrorCode:     ec,
+				Field:         field,
+				Message:       msg,
+				OriginalValue: value,
+			},
+		},
+		{
+			output: "user not authorized - userID(guest)",
+			er: ErrorResponse{
+				Field:         field,
+				Message:       msg,
+				OriginalValue: value,
+			},
+		},
+		{
 			output: "user not authorized (SESSION_ERROR) - (guest)",
 			er: ErrorResponse{
 				ErrorCode:     ec,
@@ -1179,6 +1836,38 @@ func TestErrorResponseError(t *testing.T) {
 	}
 }
 
+func TestErrorResponseList(t *testing.T) {
+	list := ErrorResponseList{
+		{ErrorCode: "MISSING", Field: "email", Message: "email is required"},
+		{ErrorCode: "BAD_FORMAT", Field: "phone", OriginalValue: "abc"},
+	}
+	want := "email is required (MISSING) - email; (BAD_FORMAT) - phone(abc)"
+	if got := list.Error(); got != want {
+		t.Errorf("expect error string\n\t%v; got\n\t%v", want, got)
+	}
+
+	w := httptest.NewRecorder()
+	WriteErrorResponseList(w, http.StatusBadRequest, list)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expect status 400; got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expect Content-Type application/json; got %v", ct)
+	}
+	got, err := ParseErrorResponse(w.Body.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(list) {
+		t.Fatalf("expect %d errors; got %v", len(list), got)
+	}
+	for i := range list {
+		if !list[i].Equal(got[i]) {
+			t.Errorf("expect %v; got %v", list[i], got[i])
+		}
+	}
+}
+
 func TestCounterCount(t *testing.T) {
 	ctx, done, err := aetest.NewContext()
 	if err != nil {
@@ -1303,3 +1992,2663 @@ func TestCounterShard(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteResult(t *testing.T) {
+	//success
+	w := httptest.NewRecorder()
+	WriteResult(w, http.StatusCreated, &Ointment{Name: "Lion"}, nil)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expect response code %d; got %d", http.StatusCreated, w.Code)
+	}
+	want := `{"data":{"id":null,"batch":0,"Expiry":"","Name":"Lion"}}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("expect JSON output\n\t%v; got\n\t%v", want, got)
+	}
+
+	//error
+	w = httptest.NewRecorder()
+	WriteResult(w, http.StatusOK, nil, NotFoundError{Kind: "Ointment"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expect response code %d; got %d", http.StatusNotFound, w.Code)
+	}
+	want = `{"error":{"message":"'Ointment' entity not found"}}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("expect JSON output\n\t%v; got\n\t%v", want, got)
+	}
+
+	//ErrorResponse is passed through as-is
+	w = httptest.NewRecorder()
+	er := ErrorResponse{ErrorCode: "BAD_FORMAT", Field: "email"}
+	WriteResult(w, http.StatusOK, nil, er)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expect response code %d; got %d", http.StatusBadRequest, w.Code)
+	}
+	want = `{"error":{"errorCode":"BAD_FORMAT","field":"email"}}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("expect JSON output\n\t%v; got\n\t%v", want, got)
+	}
+
+	//internal errors are not exposed by default
+	for _, expose := range []bool{false, true} {
+		ExposeInternalErrors = expose
+		w = httptest.NewRecorder()
+		WriteResult(w, http.StatusOK, nil, errors.New("datastore: connection reset"))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expect response code %d; got %d", http.StatusInternalServerError, w.Code)
+		}
+		want = `{"error":{"errorCode":"INTERNAL","message":"internal server error"}}`
+		if expose {
+			want = `{"error":{"errorCode":"INTERNAL","message":"datastore: connection reset"}}`
+		}
+		if got := w.Body.String(); got != want {
+			t.Errorf("expect JSON output\n\t%v; got\n\t%v", want, got)
+		}
+	}
+	ExposeInternalErrors = false
+
+	//StatusCode of ErrorResponse is used
+	w = httptest.NewRecorder()
+	WriteResult(w, 0, nil, ErrorResponse{ErrorCode: "GONE", StatusCode: http.StatusNotFound})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expect response code %d; got %d", http.StatusNotFound, w.Code)
+	}
+
+	//ErrorResponseList keeps every error
+	w = httptest.NewRecorder()
+	list := ErrorResponseList{
+		{ErrorCode: "VALIDATION", Field: "name", Message: "Name is required"},
+		{ErrorCode: "VALIDATION", Field: "email", Message: "Email is invalid"},
+	}
+	WriteResult(w, http.StatusOK, nil, list)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expect response code %d; got %d", http.StatusBadRequest, w.Code)
+	}
+	want = `{"error":[{"errorCode":"VALIDATION","field":"name","message":"Name is required"},` +
+		`{"errorCode":"VALIDATION","field":"email","message":"Email is invalid"}]}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("expect JSON output\n\t%v; got\n\t%v", want, got)
+	}
+}
+
+func TestSortEntities(t *testing.T) {
+	t1, _ := NewDateTime("2017-01-01T00:00:00Z")
+	t2, _ := NewDateTime("2018-01-01T00:00:00Z")
+	ms := []Datastorer{
+		&Ointment{Batch: 2, Expiry: t2, Name: "Tiger"},
+		&Ointment{Batch: 3, Expiry: t1, Name: "Lion"},
+		&Ointment{Batch: 1, Expiry: t2, Name: "Zebra"},
+	}
+	names := func() string {
+		s := make([]string, len(ms))
+		for i, m := range ms {
+			s[i] = m.(*Ointment).Name
+		}
+		return strings.Join(s, ",")
+	}
+
+	cases := []struct {
+		field   string
+		asc     bool
+		want    string
+		wantErr bool
+	}{
+		{field: "Name", asc: true, want: "Lion,Tiger,Zebra"},
+		{field: "Batch", asc: false, want: "Lion,Tiger,Zebra"},
+		{field: "Batch", asc: true, want: "Zebra,Tiger,Lion"},
+		{field: "Expiry", asc: true, want: "Lion,Zebra,Tiger"},
+		{field: "KeyID", asc: true, want: "Lion,Zebra,Tiger", wantErr: true},
+		{field: "Missing", asc: true, want: "Lion,Zebra,Tiger", wantErr: true},
+	}
+	for _, c := range cases {
+		err := SortEntities(ms, c.field, c.asc)
+		if c.wantErr && !IsTypeError(err) {
+			t.Errorf("%v: expect TypeError; got %v", c.field, err)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("%v: expect no error; got %v", c.field, err)
+		}
+		if got := names(); c.want != got {
+			t.Errorf("%v (asc: %v): expect order %v; got %v",
+				c.field, c.asc, c.want, got)
+		}
+	}
+}
+
+func TestEnsureKeyMatches(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	k1 := datastore.NewKey(ctx, "Ointment", "one", 0, nil)
+	k2 := datastore.NewKey(ctx, "Ointment", "two", 0, nil)
+	if e := EnsureKeyMatches(k1.Encode(), &Ointment{KeyID: k1}); e != nil {
+		t.Errorf("expect matching keys to return nil; got %v", e)
+	}
+	if e := EnsureKeyMatches(k2.Encode(), &Ointment{KeyID: k1}); !IsMismatchError(e) {
+		t.Errorf("expect mismatched keys to return MismatchError; got %v", e)
+	}
+	if e := EnsureKeyMatches(k1.Encode(), &Ointment{}); e != nil {
+		t.Errorf("expect nil key to return nil; got %v", e)
+	}
+}
+
+func TestGroupCount(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	batches := []int{1, 2, 1, 1, 2}
+	for i, b := range batches {
+		m := &Ointment{Batch: b, Name: fmt.Sprintf("O%d", i)}
+		if e := Save(ctx, m); e != nil {
+			t.Fatal(e)
+		}
+	}
+	counts, err := GroupCount(ctx, "Ointment", "Batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Errorf("expect 2 groups; got %d (%v)", len(counts), counts)
+	}
+	if counts[int64(1)] != 3 {
+		t.Errorf("expect 3 entities with batch 1; got %d", counts[int64(1)])
+	}
+	if counts[int64(2)] != 2 {
+		t.Errorf("expect 2 entities with batch 2; got %d", counts[int64(2)])
+	}
+
+	//key values are grouped by the key, not the pointer
+	owners := []*datastore.Key{
+		datastore.NewKey(ctx, "User", "u1", 0, nil),
+		datastore.NewKey(ctx, "User", "u2", 0, nil),
+		datastore.NewKey(ctx, "User", "u1", 0, nil),
+	}
+	for _, o := range owners {
+		props := datastore.PropertyList{{Name: "Owner", Value: o}}
+		k := datastore.NewIncompleteKey(ctx, "Pet", nil)
+		if _, e := datastore.Put(ctx, k, &props); e != nil {
+			t.Fatal(e)
+		}
+	}
+	counts, err = GroupCount(ctx, "Pet", "Owner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Errorf("expect 2 groups; got %d (%v)", len(counts), counts)
+	}
+	if n := counts[owners[0].Encode()]; n != 2 {
+		t.Errorf("expect 2 entities owned by u1; got %d", n)
+	}
+}
+
+func TestCheckSessionSliding(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	c, err := MakeSessionCookie(ctx, "session", "sliding", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := datastore.DecodeKey(c.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := &Session{}
+	if e := datastore.Get(ctx, k, prev); e != nil {
+		t.Fatal(e)
+	}
+	extend := 10 * time.Second
+	for i := 0; i < 2; i++ {
+		if !CheckSessionSliding(ctx, c.Value, extend) {
+			t.Fatalf("check %d: expect session to be valid", i+1)
+		}
+		s := &Session{}
+		if e := datastore.Get(ctx, k, s); e != nil {
+			t.Fatal(e)
+		}
+		//Datastore stores time in microseconds
+		want := prev.Expiration.Add(extend).Truncate(time.Microsecond)
+		if !want.Equal(s.Expiration.Truncate(time.Microsecond)) {
+			t.Errorf("check %d: expect expiration to move by %v to %v; got %v",
+				i+1, extend, want, s.Expiration)
+		}
+		prev = s
+	}
+
+	if CheckSessionSliding(ctx, "invalid-ID", extend) {
+		t.Error("expect invalid ID to be invalid")
+	}
+	c2, err := MakeSessionCookie(ctx, "session", "expired", -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if CheckSessionSliding(ctx, c2.Value, extend) {
+		t.Error("expect expired session to be invalid")
+	}
+}
+
+func TestKeyFor(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	k1, err := datastore.DecodeKey(KeyForName(ctx, "User", "jo@example.com").Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k1.Kind() != "User" || k1.StringID() != "jo@example.com" || k1.IntID() != 0 {
+		t.Errorf("expect key User/jo@example.com; got %v/%v/%v",
+			k1.Kind(), k1.StringID(), k1.IntID())
+	}
+	k2, err := datastore.DecodeKey(KeyForID(ctx, "Ointment", 42).Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k2.Kind() != "Ointment" || k2.StringID() != "" || k2.IntID() != 42 {
+		t.Errorf("expect key Ointment/42; got %v/%v/%v",
+			k2.Kind(), k2.StringID(), k2.IntID())
+	}
+	if k1.Parent() != nil || k2.Parent() != nil {
+		t.Error("expect keys to be root keys")
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	t1, _ := NewDateTime("2017-07-03T09:44:00+08:00")
+	t2, _ := NewDateTime("2017-07-03T10:44:00+08:00")
+	t3 := DateTime{t1.Add(500 * time.Millisecond)}
+	cases := []struct {
+		title   string
+		earlier DateTime
+		later   DateTime
+		wantErr bool
+	}{
+		{"In order", t1, t2, false},
+		{"Reversed", t2, t1, true},
+		{"Equal", t1, t1, false},
+		{"Sub-second difference", t3, t1, false},
+	}
+	for _, c := range cases {
+		err := ValidateOrder(c.earlier, c.later, "End")
+		if c.wantErr && !IsValidityError(err) {
+			t.Errorf("%v: expect ValidityError; got %v", c.title, err)
+		}
+		if !c.wantErr && err != nil {
+			t.Errorf("%v: expect no error; got %v", c.title, err)
+		}
+	}
+}
+
+func TestValidateSessions(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	cached, err := MakeSessionCookie(ctx, "session", "cached", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := MakeSessionCookie(ctx, "session", "stored", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memcache.Delete(ctx, stored.Value)
+	expired, err := MakeSessionCookie(ctx, "session", "expired", -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := datastore.NewKey(ctx, KindSession, "", 12, nil).Encode()
+
+	got := ValidateSessions(ctx, []string{
+		cached.Value, stored.Value, expired.Value, missing, "invalid-ID",
+	})
+	if len(got) != 2 {
+		t.Errorf("expect 2 valid sessions; got %d", len(got))
+	}
+	for _, id := range []string{cached.Value, stored.Value} {
+		if _, ok := got[id]; !ok {
+			t.Errorf("expect session '%v' to be valid", id)
+		}
+	}
+	if s, ok := got[stored.Value]; ok && s.Value != `"stored"` {
+		t.Errorf("expect session value '%v'; got '%v'", `"stored"`, s.Value)
+	}
+	if _, err := memcache.Get(ctx, stored.Value); err != nil {
+		t.Errorf("expect session loaded from Datastore to be cached; got %v", err)
+	}
+}
+
+func TestPrepDateRange(t *testing.T) {
+	from, _ := NewDateTime("2017-07-03T09:44:00+08:00")
+	to, _ := NewDateTime("2017-07-04T09:44:00+08:00")
+	cases := []struct {
+		title     string
+		query     string
+		wantStart DateTime
+		wantEnd   DateTime
+		wantErr   bool
+	}{
+		{
+			title:     "Both present",
+			query:     "from=2017-07-03T09:44:00%2B08:00&to=2017-07-04T09:44:00%2B08:00",
+			wantStart: from,
+			wantEnd:   to,
+		},
+		{
+			title:     "From only",
+			query:     "from=2017-07-03T09:44:00%2B08:00",
+			wantStart: from,
+		},
+		{
+			title: "Neither",
+			query: "ipp=20",
+		},
+		{
+			title:   "Malformed from",
+			query:   "from=2017-07-03&to=2017-07-04T09:44:00%2B08:00",
+			wantErr: true,
+		},
+		{
+			title:   "Malformed to",
+			query:   "to=tomorrow",
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		params, _ := url.ParseQuery(c.query)
+		dtr, err := PrepDateRange(params)
+		if c.wantErr {
+			if !IsInvalidError(err) {
+				t.Errorf("%v: expect InvalidError; got %v", c.title, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: expect no error; got %v", c.title, err)
+		}
+		if !c.wantStart.Equal(dtr.Start) || c.wantStart.IsZero() != dtr.Start.IsZero() {
+			t.Errorf("%v: expect start %v; got %v", c.title, c.wantStart, dtr.Start)
+		}
+		if !c.wantEnd.Equal(dtr.End) || c.wantEnd.IsZero() != dtr.End.IsZero() {
+			t.Errorf("%v: expect end %v; got %v", c.title, c.wantEnd, dtr.End)
+		}
+	}
+}
+
+func TestSaveIfChanged(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	m1 := &Ointment{Batch: 1, Name: "Lion"}
+	changed, err := SaveIfChanged(ctx, m1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expect new entity to be saved")
+	}
+	m2 := &Ointment{}
+	if e := LoadByKey(ctx, m1.Key(), m2); e != nil {
+		t.Fatal(e)
+	}
+	if !EntitiesEqual(m1, m2) {
+		t.Error("expect loaded entity to be equal to saved entity")
+	}
+	changed, err = SaveIfChanged(ctx, m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed {
+		t.Error("expect unchanged entity not to be saved")
+	}
+	m2.Batch = 2
+	if EntitiesEqual(m1, m2) {
+		t.Error("expect modified entity not to be equal to saved entity")
+	}
+	changed, err = SaveIfChanged(ctx, m2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed {
+		t.Error("expect changed entity to be saved")
+	}
+	m3 := &Ointment{}
+	if e := LoadByKey(ctx, m1.Key(), m3); e != nil {
+		t.Fatal(e)
+	}
+	if m3.Batch != 2 {
+		t.Errorf("expect stored batch to be 2; got %d", m3.Batch)
+	}
+	if _, e := SaveIfChanged(ctx, &Ointment{}); !IsValidityError(e) {
+		t.Errorf("expect ValidityError for invalid entity; got %v", e)
+	}
+}
+
+func TestCounterShardKeys(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	keys, err := CounterShardKeys(ctx, "debugged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("expect no shards before incrementing; got %d", len(keys))
+	}
+	for i := 0; i < 3; i++ {
+		if e := CounterIncrement(ctx, "debugged"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	keys, err = CounterShardKeys(ctx, "debugged")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) < 1 || len(keys) > 3 {
+		t.Errorf("expect between 1 and 3 shards; got %d", len(keys))
+	}
+	for _, k := range keys {
+		if k.Kind() != KindCounterShard {
+			t.Errorf("expect key of kind %v; got %v", KindCounterShard, k.Kind())
+		}
+		if !strings.HasPrefix(k.StringID(), "debugged-shard") {
+			t.Errorf("expect shard of counter 'debugged'; got %v", k.StringID())
+		}
+	}
+}
+
+type Booking struct {
+	KeyID *datastore.Key `json:"id" datastore:"-"`
+	Guest string
+	Note  string `json:"-"`
+	Start DateTime
+}
+
+func (this *Booking) Key() *datastore.Key { return this.KeyID }
+
+func (this *Booking) MakeKey(ctx context.Context) *datastore.Key {
+	if this.KeyID == nil {
+		this.KeyID = datastore.NewIncompleteKey(ctx, "Booking", nil)
+	}
+	return this.KeyID
+}
+
+func (this *Booking) SetKey(key *datastore.Key) error {
+	this.KeyID = key
+	return nil
+}
+
+func (this *Booking) ValidationError() []string { return []string{} }
+
+func TestApplyMergePatch(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	m0 := &Ointment{Batch: 5, Name: "Lion"}
+	if e := Save(ctx, m0); e != nil {
+		t.Fatal(e)
+	}
+	k := m0.Key()
+
+	m1 := &Ointment{}
+	if e := ApplyMergePatch(ctx, k, []byte(`{"batch":7}`), m1); e != nil {
+		t.Fatal(e)
+	}
+	m2 := &Ointment{}
+	if e := LoadByKey(ctx, k, m2); e != nil {
+		t.Fatal(e)
+	}
+	if m2.Batch != 7 {
+		t.Errorf("expect patched batch to be 7; got %d", m2.Batch)
+	}
+	if m2.Name != m0.Name {
+		t.Errorf("expect name to be unchanged '%v'; got '%v'", m0.Name, m2.Name)
+	}
+	if m1.Key() == nil || !m1.Key().Equal(k) {
+		t.Errorf("expect patched model to have key %v; got %v", k, m1.Key())
+	}
+
+	//removing a required field fails validation
+	if e := ApplyMergePatch(ctx, k, []byte(`{"Name":null}`), &Ointment{}); !IsValidityError(e) {
+		t.Errorf("expect ValidityError; got %v", e)
+	}
+	if e := ApplyMergePatch(ctx, k, []byte(`{"batch":`), &Ointment{}); !IsJSONUnmarshalError(e) {
+		t.Errorf("expect JSONUnmarshalError; got %v", e)
+	}
+	m3 := &Ointment{}
+	if e := LoadByKey(ctx, k, m3); e != nil {
+		t.Fatal(e)
+	}
+	if m3.Name != m0.Name || m3.Batch != 7 {
+		t.Errorf("expect failed patches not to be saved; got %+v", m3)
+	}
+
+	//fields not in the patch are kept as loaded
+	start := time.Date(2024, 7, 3, 14, 30, 15, 123456000, time.UTC)
+	b0 := &Booking{Guest: "Ali", Note: "window seat", Start: DateTime{start}}
+	if e := Save(ctx, b0); e != nil {
+		t.Fatal(e)
+	}
+	if e := ApplyMergePatch(ctx, b0.Key(), []byte(`{"Guest":"Bala"}`), &Booking{}); e != nil {
+		t.Fatal(e)
+	}
+	b1 := &Booking{}
+	if e := LoadByKey(ctx, b0.Key(), b1); e != nil {
+		t.Fatal(e)
+	}
+	if b1.Guest != "Bala" {
+		t.Errorf("expect patched guest to be Bala; got %v", b1.Guest)
+	}
+	if b1.Note != b0.Note {
+		t.Errorf("expect note to be unchanged '%v'; got '%v'", b0.Note, b1.Note)
+	}
+	if !b1.Start.Time.Equal(start) {
+		t.Errorf("expect start to be unchanged %v; got %v", start, b1.Start.Time)
+	}
+	if e := ApplyMergePatch(ctx, b0.Key(), []byte(`{"guest":null}`), &Booking{}); e != nil {
+		t.Fatal(e)
+	}
+	b2 := &Booking{}
+	if e := LoadByKey(ctx, b0.Key(), b2); e != nil {
+		t.Fatal(e)
+	}
+	if b2.Guest != "" || b2.Note != b0.Note || !b2.Start.Time.Equal(start) {
+		t.Errorf("expect only the guest to be removed; got %+v", b2)
+	}
+}
+
+func TestIsInternalRequest(t *testing.T) {
+	cases := []struct {
+		title  string
+		header string
+		value  string
+		want   bool
+	}{
+		{"External", "", "", false},
+		{"Cron", HeaderCron, "true", true},
+		{"Task queue", HeaderQueueName, "default", true},
+		{"Other header", "X-Appengine-Country", "SG", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/maintenance", nil)
+		if c.header != "" {
+			r.Header.Set(c.header, c.value)
+		}
+		if got := IsInternalRequest(r); c.want != got {
+			t.Errorf("%v: expect IsInternalRequest to return %v; got %v",
+				c.title, c.want, got)
+		}
+	}
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	p1, _ := url.ParseQuery("ipp=20&cursor=abc&batch=3")
+	p2, _ := url.ParseQuery("batch=3&ipp=20&cursor=abc")
+	p3, _ := url.ParseQuery("batch=3&ipp=20&cursor=abd")
+	k1 := QueryCacheKey("Ointment", p1)
+	k2 := QueryCacheKey("Ointment", p2)
+	if k1 != k2 {
+		t.Errorf("expect same key for same parameters; got\n\t%v\n\t%v", k1, k2)
+	}
+	if !strings.HasPrefix(k1, "Ointment:") {
+		t.Errorf("expect key to be prefixed with the kind; got %v", k1)
+	}
+	if k3 := QueryCacheKey("Ointment", p3); k1 == k3 {
+		t.Errorf("expect different keys for different parameters; got %v", k3)
+	}
+	if k4 := QueryCacheKey("Package", p1); k1 == k4 {
+		t.Errorf("expect different keys for different kinds; got %v", k4)
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	test := func(title string, want bool) {
+		got, err := AcquireLock(ctx, "maintenance", time.Minute)
+		if err != nil {
+			t.Fatalf("%v: %v", title, err)
+		}
+		if want != got {
+			t.Errorf("%v: expect AcquireLock to return %v; got %v", title, want, got)
+		}
+	}
+	test("First acquire", true)
+	test("Second acquire", false)
+	if e := ReleaseLock(ctx, "maintenance"); e != nil {
+		t.Fatal(e)
+	}
+	test("Acquire after release", true)
+	if e := ReleaseLock(ctx, "maintenance"); e != nil {
+		t.Fatal(e)
+	}
+
+	//expired lock can be acquired
+	if ok, e := AcquireLock(ctx, "expiring", -time.Second); e != nil || !ok {
+		t.Fatalf("expect lock to be acquired; got %v, %v", ok, e)
+	}
+	if ok, e := AcquireLock(ctx, "expiring", time.Minute); e != nil || !ok {
+		t.Errorf("expect expired lock to be acquired; got %v, %v", ok, e)
+	}
+}
+
+func TestLockToken(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	token, err := AcquireLockToken(ctx, "maintenance", time.Minute)
+	if err != nil || token == "" {
+		t.Fatalf("expect lock to be acquired; got %q, %v", token, err)
+	}
+	if t2, e := AcquireLockToken(ctx, "maintenance", time.Minute); e != nil || t2 != "" {
+		t.Errorf("expect held lock to not be acquired; got %q, %v", t2, e)
+	}
+	if e := ReleaseLockToken(ctx, "maintenance", token); e != nil {
+		t.Fatal(e)
+	}
+	if e := ReleaseLockToken(ctx, "maintenance", token); e != nil {
+		t.Errorf("expect releasing a lock that is not held to succeed; got %v", e)
+	}
+
+	//expired lock can be acquired with a new token
+	first, e := AcquireLockToken(ctx, "expiring", -time.Second)
+	if e != nil || first == "" {
+		t.Fatalf("expect lock to be acquired; got %q, %v", first, e)
+	}
+	second, e := AcquireLockToken(ctx, "expiring", time.Minute)
+	if e != nil || second == "" {
+		t.Fatalf("expect expired lock to be acquired; got %q, %v", second, e)
+	}
+	if first == second {
+		t.Errorf("expect a new token; got %v", second)
+	}
+
+	//the previous holder cannot release the lock of the new holder
+	if e := ReleaseLockToken(ctx, "expiring", first); !IsConflictError(e) {
+		t.Errorf("expect ConflictError for another holder; got %v", e)
+	}
+	if ok, e := AcquireLock(ctx, "expiring", time.Minute); e != nil || ok {
+		t.Errorf("expect lock to still be held; got %v, %v", ok, e)
+	}
+	if e := ReleaseLockToken(ctx, "expiring", second); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestQueryChan(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	for i := 1; i <= 3; i++ {
+		if e := Save(ctx, &Ointment{Batch: i, Name: fmt.Sprintf("O%d", i)}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	q := datastore.NewQuery("Ointment").Order("Batch")
+	out, errc := QueryChan(ctx, q, func() Datastorer { return &Ointment{} }, 1)
+	n := 0
+	for m := range out {
+		n++
+		o := m.(*Ointment)
+		if o.Batch != n {
+			t.Errorf("expect entity %d to have batch %d; got %d", n, n, o.Batch)
+		}
+		if o.Key() == nil {
+			t.Errorf("expect entity %d to have its key set", n)
+		}
+	}
+	if e := <-errc; e != nil {
+		t.Fatal(e)
+	}
+	if n != 3 {
+		t.Errorf("expect 3 entities from the channel; got %d", n)
+	}
+}
+
+func TestDecodeKeys(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	k1 := KeyForName(ctx, "Ointment", "one")
+	k2 := KeyForID(ctx, "Ointment", 2)
+	keys, err := DecodeKeys([]string{k1.Encode(), k2.Encode()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !k1.Equal(keys[0]) || !k2.Equal(keys[1]) {
+		t.Errorf("expect keys %v and %v; got %v", k1, k2, keys)
+	}
+
+	_, err = DecodeKeys([]string{k1.Encode(), "invalid-key", k2.Encode()})
+	if !IsInvalidError(err) {
+		t.Fatalf("expect InvalidError; got %v", err)
+	}
+	if !strings.Contains(err.Error(), "index 1") {
+		t.Errorf("expect error to identify index 1; got %v", err)
+	}
+}
+
+func TestWriteMethodNotAllowed(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteMethodNotAllowed(w, http.MethodGet, http.MethodPut)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expect response code %d; got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+	if got := w.Header().Get("Allow"); got != "GET, PUT" {
+		t.Errorf("expect Allow header 'GET, PUT'; got '%v'", got)
+	}
+	er := ErrorResponse{}
+	if e := json.Unmarshal(w.Body.Bytes(), &er); e != nil {
+		t.Fatal(e)
+	}
+	if er.ErrorCode != "METHOD_NOT_ALLOWED" {
+		t.Errorf("expect error code METHOD_NOT_ALLOWED; got %v", er.ErrorCode)
+	}
+}
+
+type Signup struct {
+	KeyID *datastore.Key `json:"id"`
+	Email string
+	Name  string
+}
+
+func (this *Signup) Key() *datastore.Key { return this.KeyID }
+
+func (this *Signup) MakeKey(ctx context.Context) *datastore.Key {
+	if this.KeyID == nil {
+		this.KeyID = datastore.NewIncompleteKey(ctx, "Signup", nil)
+	}
+	return this.KeyID
+}
+
+func (this *Signup) SetKey(key *datastore.Key) error {
+	this.KeyID = key
+	return nil
+}
+
+func (this *Signup) ValidationError() []string {
+	return this.ValidationErrorFor([]string{"Email", "Name"})
+}
+
+func (this *Signup) ValidationErrorFor(fields []string) []string {
+	msg := make([]string, 0, len(fields))
+	for _, f := range fields {
+		switch {
+		case f == "Email" && this.Email == "":
+			msg = append(msg, "Email is required")
+		case f == "Name" && this.Name == "":
+			msg = append(msg, "Name is required")
+		}
+	}
+	return msg
+}
+
+func TestValidatePartial(t *testing.T) {
+	s := &Signup{}
+	got := ValidatePartial(s, []string{"Name"})
+	if len(got) != 1 || got[0] != "Name is required" {
+		t.Errorf("expect only the Name error; got %v", got)
+	}
+	if got := ValidatePartial(s, nil); len(got) != 0 {
+		t.Errorf("expect no errors when no fields are specified; got %v", got)
+	}
+	if got := s.ValidationError(); len(got) != 2 {
+		t.Errorf("expect full validation to return 2 errors; got %v", got)
+	}
+	//falls back to ValidationError
+	if got := ValidatePartial(&Ointment{Batch: 1}, []string{"Batch"}); len(got) != 1 {
+		t.Errorf("expect full validation for non-PartialValidator; got %v", got)
+	}
+}
+
+func TestSaveNormalizedUTC(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	d1, _ := NewDateTime("2017-07-03T09:44:00+08:00")
+	if u := d1.UTC(); u.Location() != time.UTC || !d1.Equal(u) {
+		t.Errorf("expect %v in UTC; got %v", d1, u)
+	}
+
+	m := &Ointment{Expiry: d1, Name: "Lion"}
+	if e := SaveNormalizedUTC(ctx, m); e != nil {
+		t.Fatal(e)
+	}
+	if m.Expiry.Location() != time.UTC {
+		t.Errorf("expect expiry to be in UTC; got %v", m.Expiry)
+	}
+	if want := "2017-06-03T01:44:00Z"; m.Expiry.String() != want {
+		t.Errorf("expect expiry %v; got %v", want, m.Expiry.String())
+	}
+
+	//nested values
+	type schedule struct {
+		Start  DateTime
+		End    *DateTime
+		Breaks []DateTime
+		Info   struct {
+			Updated DateTime
+		}
+	}
+	end := d1.AddDate(0, 0, 1)
+	s := &schedule{
+		Start:  d1,
+		End:    &end,
+		Breaks: []DateTime{d1, d1},
+	}
+	s.Info.Updated = d1
+	normalizeUTC(reflect.ValueOf(s))
+	for _, d := range []DateTime{s.Start, *s.End, s.Breaks[0], s.Breaks[1], s.Info.Updated} {
+		if d.Location() != time.UTC {
+			t.Errorf("expect %v to be in UTC", d)
+		}
+	}
+}
+
+func TestTimed(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	var gotName string
+	var gotDur time.Duration = -1
+	TimedHook = func(name string, d time.Duration) {
+		gotName = name
+		gotDur = d
+	}
+	defer func() { TimedHook = nil }()
+
+	e1 := errors.New("failed")
+	if e := Timed(ctx, "op", func() error { return e1 }); e != e1 {
+		t.Errorf("expect error %v; got %v", e1, e)
+	}
+	if gotName != "op" {
+		t.Errorf("expect name 'op'; got '%v'", gotName)
+	}
+	if gotDur < 0 {
+		t.Errorf("expect duration to be non-negative; got %v", gotDur)
+	}
+	if e := Timed(ctx, "op", func() error { return nil }); e != nil {
+		t.Errorf("expect nil error; got %v", e)
+	}
+}
+
+func TestMustLoadByID(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	if e := MustLoadByID(ctx, "invalid-key", "Ointment", &Ointment{}); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed ID; got %v", e)
+	}
+
+	k := datastore.NewKey(ctx, "Ointment", "missing", 0, nil)
+	e := MustLoadByID(ctx, k.Encode(), "Ointment", &Ointment{})
+	if nf, ok := e.(NotFoundError); !ok || nf.Kind != "Ointment" {
+		t.Errorf("expect NotFoundError for 'Ointment'; got %v", e)
+	}
+
+	m := &Ointment{Name: "Lion"}
+	if e := Save(ctx, m); e != nil {
+		t.Fatal(e)
+	}
+	m2 := &Ointment{}
+	if e := MustLoadByID(ctx, m.Key().Encode(), "Ointment", m2); e != nil {
+		t.Fatalf("expect entity to be loaded; got %v", e)
+	}
+	if m2.Name != "Lion" || !m2.Key().Equal(m.Key()) {
+		t.Errorf("expect loaded entity %v; got %v", m, m2)
+	}
+}
+
+func TestPageToken(t *testing.T) {
+	if _, e := EncodePageToken(10, "abc", nil); !IsMissingError(e) {
+		t.Errorf("expect MissingError without secret; got %v", e)
+	}
+	PageTokenSecret = []byte("secret")
+	defer func() { PageTokenSecret = nil }()
+
+	filters := url.Values{"status": []string{"active"}, "tag": []string{"a", "b"}}
+	token, err := EncodePageToken(25, "CjsSNWoP", filters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(token, "CjsSNWoP") {
+		t.Errorf("expect cursor to not be visible in token; got %v", token)
+	}
+	limit, cursor, f, err := DecodePageToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != 25 || cursor != "CjsSNWoP" || !reflect.DeepEqual(filters, f) {
+		t.Errorf("expect 25, 'CjsSNWoP', %v; got %v, '%v', %v", filters, limit, cursor, f)
+	}
+
+	//tamper with the payload
+	other, _ := EncodePageToken(1000, "CjsSNWoP", filters)
+	tampered := strings.Split(other, ".")[0] + "." + strings.Split(token, ".")[1]
+	if _, _, _, e := DecodePageToken(tampered); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for tampered token; got %v", e)
+	}
+	if _, _, _, e := DecodePageToken("garbage"); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed token; got %v", e)
+	}
+}
+
+func TestDateTimeRange(t *testing.T) {
+	d1, _ := NewDateTime("2016-01-01T10:00:00Z")
+	d2, _ := NewDateTime("2016-01-01T12:00:00Z")
+	d3, _ := NewDateTime("2016-01-01T14:00:00Z")
+	d4, _ := NewDateTime("2016-01-01T16:00:00Z")
+
+	r1 := DateTimeRange{Start: d1, End: d3}
+	inverted := DateTimeRange{Start: d3, End: d1}
+	openStart := DateTimeRange{End: d2}
+	openEnd := DateTimeRange{Start: d3}
+	unbounded := DateTimeRange{}
+
+	containCases := []struct {
+		title string
+		r     DateTimeRange
+		d     DateTime
+		want  bool
+	}{
+		{"within", r1, d2, true},
+		{"at start", r1, d1, true},
+		{"at end", r1, d3, true},
+		{"after end", r1, d4, false},
+		{"inverted", inverted, d2, false},
+		{"open start", openStart, d1, true},
+		{"open end", openEnd, d4, true},
+		{"open end before start", openEnd, d2, false},
+		{"unbounded", unbounded, d4, true},
+	}
+	for _, c := range containCases {
+		if got := c.r.Contains(c.d); c.want != got {
+			t.Errorf("%v: expect Contains to return %v; got %v", c.title, c.want, got)
+		}
+	}
+
+	overlapCases := []struct {
+		title  string
+		r1, r2 DateTimeRange
+		want   bool
+	}{
+		{"partial", r1, DateTimeRange{Start: d2, End: d4}, true},
+		{"touching", r1, DateTimeRange{Start: d3, End: d4}, true},
+		{"disjoint", DateTimeRange{Start: d1, End: d2}, DateTimeRange{Start: d3, End: d4}, false},
+		{"inverted", r1, inverted, false},
+		{"open start", openStart, r1, true},
+		{"open bounds disjoint", openStart, openEnd, false},
+		{"unbounded", unbounded, openEnd, true},
+	}
+	for _, c := range overlapCases {
+		if got := c.r1.Overlaps(c.r2); c.want != got {
+			t.Errorf("%v: expect Overlaps to return %v; got %v", c.title, c.want, got)
+		}
+		if got := c.r2.Overlaps(c.r1); c.want != got {
+			t.Errorf("%v (reversed): expect Overlaps to return %v; got %v", c.title, c.want, got)
+		}
+	}
+
+	if !r1.Valid() || !unbounded.Valid() || !openEnd.Valid() {
+		t.Error("expect ranges to be valid")
+	}
+	if inverted.Valid() {
+		t.Error("expect inverted range to be invalid")
+	}
+
+	b, err := json.Marshal(DateTimeRange{Start: d1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"start":"2016-01-01T10:00:00Z","end":""}`; string(b) != want {
+		t.Errorf("expect %v; got %v", want, string(b))
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	cases := []struct {
+		title string
+		m     Datastorer
+		want  []string
+	}{
+		{"Presaver", &Ointment{}, []string{"Presaver"}},
+		{"PartialValidator", &Signup{}, []string{"PartialValidator"}},
+	}
+	for _, c := range cases {
+		if got := Capabilities(c.m); !reflect.DeepEqual(c.want, got) {
+			t.Errorf("%v: expect %v; got %v", c.title, c.want, got)
+		}
+	}
+}
+
+func TestCounterDecrement(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	for i := 0; i < 3; i++ {
+		if e := CounterIncrement(ctx, "stock"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := CounterDecrement(ctx, "stock"); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := CounterCount(ctx, "stock"); e != nil || n != 2 {
+		t.Errorf("expect counter to be 2; got %d (%v)", n, e)
+	}
+	//decrement through the cached value and below zero
+	for i := 0; i < 4; i++ {
+		if e := CounterDecrement(ctx, "stock"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if n, e := CounterCount(ctx, "stock"); e != nil || n != -2 {
+		t.Errorf("expect counter to be -2; got %d (%v)", n, e)
+	}
+}
+
+func TestServeList(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	for _, name := range []string{"A", "B", "C"} {
+		if e := Save(ctx, &Ointment{Name: name}); e != nil {
+			t.Fatal(e)
+		}
+	}
+	q := datastore.NewQuery("Ointment").Order("Name")
+	factory := func() Datastorer { return &Ointment{} }
+
+	cursor := ""
+	cases := []struct {
+		wantNames  []string
+		wantCursor bool
+	}{
+		{[]string{"A", "B"}, true},
+		{[]string{"C"}, false},
+	}
+	for i, c := range cases {
+		params := url.Values{"ipp": []string{"2"}, "cursor": []string{cursor}}
+		r, err := inst.NewRequest("GET", "/ointments?"+params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if e := ServeList(w, r, q, factory); e != nil {
+			t.Fatalf("page %d: %v", i, e)
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("page %d: expect status 200; got %d", i, w.Code)
+		}
+		var got []Ointment
+		if e := json.Unmarshal(w.Body.Bytes(), &got); e != nil {
+			t.Fatalf("page %d: %v", i, e)
+		}
+		names := []string{}
+		for _, m := range got {
+			names = append(names, m.Name)
+		}
+		if !reflect.DeepEqual(c.wantNames, names) {
+			t.Errorf("page %d: expect %v; got %v", i, c.wantNames, names)
+		}
+		cursor = w.Header().Get(HeaderCursor)
+		if c.wantCursor != (cursor != "") {
+			t.Errorf("page %d: expect cursor presence %v; got '%v'", i, c.wantCursor, cursor)
+		}
+	}
+
+	//invalid page sizes use the default, which covers all the results
+	for _, ipp := range []string{"0", "-1", "abc"} {
+		r, err := inst.NewRequest("GET", "/ointments?ipp="+ipp, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		if e := ServeList(w, r, q, factory); e != nil {
+			t.Fatalf("ipp=%v: %v", ipp, e)
+		}
+		var got []Ointment
+		if e := json.Unmarshal(w.Body.Bytes(), &got); e != nil {
+			t.Fatalf("ipp=%v: %v", ipp, e)
+		}
+		if len(got) != 3 {
+			t.Errorf("ipp=%v: expect 3 results; got %d", ipp, len(got))
+		}
+		if c := w.Header().Get(HeaderCursor); c != "" {
+			t.Errorf("ipp=%v: expect no cursor; got '%v'", ipp, c)
+		}
+	}
+
+	r, err = inst.NewRequest("GET", "/ointments?cursor=%25bad", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := ServeList(httptest.NewRecorder(), r, q, factory); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for bad cursor; got %v", e)
+	}
+
+	//cursor from a differently-filtered list
+	w := httptest.NewRecorder()
+	r, err = inst.NewRequest("GET", "/ointments?ipp=1&batch=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := ServeList(w, r, q, factory); e != nil {
+		t.Fatal(e)
+	}
+	params := url.Values{"cursor": []string{w.Header().Get(HeaderCursor)},
+		"batch": []string{"2"}}
+	r, err = inst.NewRequest("GET", "/ointments?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := ServeList(httptest.NewRecorder(), r, q, factory); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for cursor of a different query; got %v", e)
+	}
+}
+
+func TestCounterReset(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	if e := CounterReset(ctx, "visits"); e != nil {
+		t.Errorf("expect resetting a non-existent counter to succeed; got %v", e)
+	}
+	if e := CounterIncreaseShards(ctx, "visits", 8); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 10; i++ {
+		if e := CounterIncrement(ctx, "visits"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if n, e := CounterCount(ctx, "visits"); e != nil || n != 10 {
+		t.Fatalf("expect counter to be 10; got %d (%v)", n, e)
+	}
+	if e := CounterReset(ctx, "visits"); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := CounterCount(ctx, "visits"); e != nil || n != 0 {
+		t.Errorf("expect counter to be 0 after reset; got %d (%v)", n, e)
+	}
+	var cfg counterConfig
+	ckey := datastore.NewKey(ctx, KindCounterConfig, "visits", 0, nil)
+	if e := datastore.Get(ctx, ckey, &cfg); e != nil || cfg.Shards != 8 {
+		t.Errorf("expect 8 shards to be kept; got %d (%v)", cfg.Shards, e)
+	}
+}
+
+func TestCacheConsistent(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	m := &Ointment{Batch: 3, Name: "Lion"}
+	if e := SaveCacheEntity(ctx, m); e != nil {
+		t.Fatal(e)
+	}
+	if ok, e := CacheConsistent(ctx, m.Key(), &Ointment{}); e != nil || !ok {
+		t.Errorf("expect cache to be consistent; got %v (%v)", ok, e)
+	}
+
+	//update the Datastore without updating the cache
+	m.Name = "Tiger"
+	if e := Save(ctx, m); e != nil {
+		t.Fatal(e)
+	}
+	if ok, e := CacheConsistent(ctx, m.Key(), &Ointment{}); e != nil || ok {
+		t.Errorf("expect stale cache to be inconsistent; got %v (%v)", ok, e)
+	}
+
+	memcache.Delete(ctx, m.Key().Encode())
+	if ok, e := CacheConsistent(ctx, m.Key(), &Ointment{}); e != nil || !ok {
+		t.Errorf("expect cache miss to be consistent; got %v (%v)", ok, e)
+	}
+
+	//sub-second times and fields not in the JSON form are not cached
+	start := time.Now().Truncate(time.Second).Add(123456 * time.Microsecond)
+	b := &Booking{Guest: "Ali", Note: "window seat", Start: DateTime{start}}
+	if e := SaveCacheEntity(ctx, b); e != nil {
+		t.Fatal(e)
+	}
+	if ok, e := CacheConsistent(ctx, b.Key(), &Booking{}); e != nil || !ok {
+		t.Errorf("expect cache with sub-second time to be consistent; got %v (%v)", ok, e)
+	}
+}
+
+func TestCounterDelete(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	if e := CounterIncreaseShards(ctx, "downloads", 12); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 5; i++ {
+		if e := CounterIncrement(ctx, "downloads"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e := CounterCount(ctx, "downloads"); e != nil {
+		t.Fatal(e)
+	}
+	if e := CounterDelete(ctx, "downloads"); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := CounterCount(ctx, "downloads"); e != nil || n != 0 {
+		t.Errorf("expect counter to be 0 after delete; got %d (%v)", n, e)
+	}
+	ckey := datastore.NewKey(ctx, KindCounterConfig, "downloads", 0, nil)
+	var cfg counterConfig
+	if e := datastore.Get(ctx, ckey, &cfg); e != datastore.ErrNoSuchEntity {
+		t.Errorf("expect configuration to be deleted; got %v", e)
+	}
+
+	//recreate
+	if e := CounterIncrement(ctx, "downloads"); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := CounterCount(ctx, "downloads"); e != nil || n != 1 {
+		t.Errorf("expect recreated counter to be 1; got %d (%v)", n, e)
+	}
+	if e := datastore.Get(ctx, ckey, &cfg); e != nil || cfg.Shards != defaultShards {
+		t.Errorf("expect %d shards; got %d (%v)", defaultShards, cfg.Shards, e)
+	}
+}
+
+func TestTimings(t *testing.T) {
+	w := httptest.NewRecorder()
+	timings := NewTimings()
+	timings.Write(w)
+	if got := w.Header().Get("Server-Timing"); got != "" {
+		t.Errorf("expect no header without timings; got '%v'", got)
+	}
+	timings.Record("db", 12500*time.Microsecond)
+	timings.Record("cache", 2*time.Millisecond)
+	timings.Write(w)
+	if want, got := "db;dur=12.5, cache;dur=2", w.Header().Get("Server-Timing"); want != got {
+		t.Errorf("expect '%v'; got '%v'", want, got)
+	}
+}
+
+func TestCounterIncrementBy(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	for i := 0; i < 11; i++ {
+		if e := CounterIncrement(ctx, "single"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := CounterIncrementBy(ctx, "bulk", 11); e != nil {
+		t.Fatal(e)
+	}
+	n1, err := CounterCount(ctx, "single")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := CounterCount(ctx, "bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n1 != 11 || n1 != n2 {
+		t.Errorf("expect both counters to be 11; got %d and %d", n1, n2)
+	}
+
+	//update the cached value
+	if e := CounterIncrementBy(ctx, "bulk", 4); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := CounterCount(ctx, "bulk"); e != nil || n != 15 {
+		t.Errorf("expect counter to be 15; got %d (%v)", n, e)
+	}
+	if e := CounterIncrementBy(ctx, "bulk", -20); e != nil {
+		t.Fatal(e)
+	}
+	if n, e := CounterCount(ctx, "bulk"); e != nil || n != -5 {
+		t.Errorf("expect counter to be -5; got %d (%v)", n, e)
+	}
+}
+
+func TestSaveConcurrent(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	//invalid models prevent any saving
+	invalid := []Datastorer{&Ointment{Name: "A"}, &Ointment{}}
+	e := SaveConcurrent(ctx, invalid, 10, 2)
+	me, ok := e.(appengine.MultiError)
+	if !ok || me[0] != nil || !IsValidityError(me[1]) {
+		t.Errorf("expect MultiError with ValidityError at index 1; got %v", e)
+	}
+	if invalid[0].Key() != nil {
+		t.Error("expect valid model to not be saved")
+	}
+
+	ms := make([]Datastorer, 1200)
+	for i := range ms {
+		ms[i] = &Ointment{Batch: i, Name: fmt.Sprintf("O%04d", i)}
+	}
+	if e := SaveConcurrent(ctx, ms, 250, 3); e != nil {
+		t.Fatal(e)
+	}
+	for i, m := range ms {
+		if m.Key() == nil || m.Key().Incomplete() {
+			t.Fatalf("expect model %d to have a complete key; got %v", i, m.Key())
+		}
+	}
+	n, err := datastore.NewQuery("Ointment").Count(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1200 {
+		t.Errorf("expect 1200 entities; got %d", n)
+	}
+}
+
+func TestListCounters(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	if names, e := ListCounters(ctx); e != nil || len(names) != 0 {
+		t.Errorf("expect no counters; got %v (%v)", names, e)
+	}
+	for _, name := range []string{"views", "likes", "views"} {
+		if e := CounterIncrement(ctx, name); e != nil {
+			t.Fatal(e)
+		}
+	}
+	names, err := ListCounters(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"likes", "views"}; !reflect.DeepEqual(want, names) {
+		t.Errorf("expect %v; got %v", want, names)
+	}
+}
+
+func TestSignCursor(t *testing.T) {
+	PageTokenSecret = []byte("secret")
+	defer func() { PageTokenSecret = nil }()
+
+	k1 := QueryCacheKey("/ointments", url.Values{"status": []string{"active"}})
+	k2 := QueryCacheKey("/ointments", url.Values{"status": []string{"expired"}})
+	signed := SignCursor(k1, "CjsSNWoP")
+	cursor, err := VerifyCursor(k1, signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cursor != "CjsSNWoP" {
+		t.Errorf("expect cursor 'CjsSNWoP'; got '%v'", cursor)
+	}
+	if _, e := VerifyCursor(k2, signed); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for a different query; got %v", e)
+	}
+	if _, e := VerifyCursor(k1, "CjsSNWoP"); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for unsigned cursor; got %v", e)
+	}
+	if _, e := VerifyCursor(k1, "CjsSNWoQ"+signed[8:]); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for tampered cursor; got %v", e)
+	}
+}
+
+func TestCounterCountFresh(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	if e := CounterIncrementBy(ctx, "orders", 7); e != nil {
+		t.Fatal(e)
+	}
+	wrong := 100
+	memcache.JSON.Set(ctx, &memcache.Item{
+		Key:    counterMemcacheKey(ctx, "orders"),
+		Object: &wrong,
+	})
+	if n, e := CounterCount(ctx, "orders"); e != nil || n != 100 {
+		t.Errorf("expect cached counter to be 100; got %d (%v)", n, e)
+	}
+	if n, e := CounterCountFresh(ctx, "orders"); e != nil || n != 7 {
+		t.Errorf("expect fresh counter to be 7; got %d (%v)", n, e)
+	}
+	if n, e := CounterCount(ctx, "orders"); e != nil || n != 7 {
+		t.Errorf("expect cache to be refreshed to 7; got %d (%v)", n, e)
+	}
+}
+
+func TestParseErrorResponse(t *testing.T) {
+	cases := []struct {
+		title   string
+		body    string
+		want    []ErrorResponse
+		wantErr bool
+	}{
+		{
+			title: "single object",
+			body:  `{"errorCode":"BAD_FORMAT","field":"email","extra":true}`,
+			want:  []ErrorResponse{{ErrorCode: "BAD_FORMAT", Field: "email"}},
+		},
+		{
+			title: "array",
+			body: ` [{"errorCode":"MISSING","field":"name"},
+				{"message":"too long","field":"bio"}]`,
+			want: []ErrorResponse{
+				{ErrorCode: "MISSING", Field: "name"},
+				{Message: "too long", Field: "bio"},
+			},
+		},
+		{title: "empty array", body: `[]`, want: []ErrorResponse{}},
+		{title: "malformed", body: `{"errorCode":`, wantErr: true},
+		{title: "wrong shape", body: `"oops"`, wantErr: true},
+	}
+	for _, c := range cases {
+		got, err := ParseErrorResponse([]byte(c.body))
+		if c.wantErr {
+			if !IsJSONUnmarshalError(err) {
+				t.Errorf("%v: expect JSONUnmarshalError; got %v", c.title, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: expect no error; got %v", c.title, err)
+			continue
+		}
+		if !reflect.DeepEqual(c.want, got) {
+			t.Errorf("%v: expect %v; got %v", c.title, c.want, got)
+		}
+	}
+}
+
+func TestCounterIncrementN(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	prev := -1
+	for i := 0; i < 10; i++ {
+		n, err := CounterIncrementN(ctx, "clicks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < prev {
+			t.Errorf("expect total to not decrease; got %d after %d", n, prev)
+		}
+		prev = n
+	}
+	if prev < 1 {
+		t.Errorf("expect total to be positive; got %d", prev)
+	}
+}
+
+type Review struct {
+	KeyID   *datastore.Key `json:"id" datastore:"-"`
+	Product string
+	Text    string
+}
+
+func (this *Review) Key() *datastore.Key { return this.KeyID }
+
+func (this *Review) MakeKey(ctx context.Context) *datastore.Key {
+	if this.KeyID == nil {
+		this.KeyID = datastore.NewIncompleteKey(ctx, "Review", nil)
+	}
+	return this.KeyID
+}
+
+func (this *Review) RelatedCacheKeys() []string {
+	return []string{"product:" + this.Product}
+}
+
+func (this *Review) SetKey(key *datastore.Key) error {
+	this.KeyID = key
+	return nil
+}
+
+func (this *Review) ValidationError() []string { return []string{} }
+
+func TestCacheInvalidator(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	related := &memcache.Item{Key: "product:p1", Value: []byte("cached product")}
+	unrelated := &memcache.Item{Key: "product:p2", Value: []byte("cached product")}
+	memcache.SetMulti(ctx, []*memcache.Item{related, unrelated})
+
+	m := &Review{Product: "p1", Text: "Great"}
+	if e := SaveCacheEntity(ctx, m); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := memcache.Get(ctx, "product:p1"); e != memcache.ErrCacheMiss {
+		t.Errorf("expect related item to be evicted on save; got %v", e)
+	}
+	if _, e := memcache.Get(ctx, "product:p2"); e != nil {
+		t.Errorf("expect unrelated item to be kept; got %v", e)
+	}
+
+	memcache.Set(ctx, related)
+	if e := DeleteEntity(ctx, m); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := memcache.Get(ctx, "product:p1"); e != memcache.ErrCacheMiss {
+		t.Errorf("expect related item to be evicted on delete; got %v", e)
+	}
+	if _, e := memcache.Get(ctx, m.Key().Encode()); e != memcache.ErrCacheMiss {
+		t.Errorf("expect entity to be evicted on delete; got %v", e)
+	}
+	if e := DeleteEntity(ctx, &Review{}); e != ErrNilKey {
+		t.Errorf("expect ErrNilKey for entity without key; got %v", e)
+	}
+}
+
+func TestCounterNS(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	increments := map[string]int{"tenant1": 2, "tenant2": 3}
+	for ns, n := range increments {
+		for i := 0; i < n; i++ {
+			if e := CounterIncrementNS(ctx, ns, "signups"); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+	for ns, want := range increments {
+		if n, e := CounterCountNS(ctx, ns, "signups"); e != nil || n != want {
+			t.Errorf("expect '%v' counter to be %d; got %d (%v)", ns, want, n, e)
+		}
+	}
+	if n, e := CounterCount(ctx, "signups"); e != nil || n != 0 {
+		t.Errorf("expect default namespace counter to be 0; got %d (%v)", n, e)
+	}
+
+	ctx1, _ := appengine.Namespace(ctx, "tenant1")
+	if want, got := KindCounterShard+":tenant1:signups", counterMemcacheKey(ctx1, "signups"); want != got {
+		t.Errorf("expect memcache key '%v'; got '%v'", want, got)
+	}
+	if want, got := KindCounterShard+":signups", counterMemcacheKey(ctx, "signups"); want != got {
+		t.Errorf("expect memcache key '%v'; got '%v'", want, got)
+	}
+}
+
+func TestPageMeta(t *testing.T) {
+	cases := []struct {
+		total, limit, offset int
+		page, pages          int
+		hasNext, hasPrev     bool
+	}{
+		{95, 10, 0, 1, 10, true, false},
+		{95, 10, 40, 5, 10, true, true},
+		{95, 10, 90, 10, 10, false, true},
+		{100, 10, 90, 10, 10, false, true},
+		{0, 10, 0, 1, 0, false, false},
+		{5, 0, 0, 1, 1, false, false},
+		{0, 0, 0, 1, 0, false, false},
+	}
+	for _, c := range cases {
+		page, pages, hasNext, hasPrev := PageMeta(c.total, c.limit, c.offset)
+		if c.page != page || c.pages != pages || c.hasNext != hasNext || c.hasPrev != hasPrev {
+			t.Errorf("PageMeta(%d, %d, %d): expect %d, %d, %v, %v; got %d, %d, %v, %v",
+				c.total, c.limit, c.offset, c.page, c.pages, c.hasNext, c.hasPrev,
+				page, pages, hasNext, hasPrev)
+		}
+	}
+}
+
+func TestCounterInit(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	if e := CounterInit(ctx, "hot", 0); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for 0 shards; got %v", e)
+	}
+	if e := CounterInit(ctx, "hot", 20); e != nil {
+		t.Fatal(e)
+	}
+	//no-op for an existing counter
+	if e := CounterInit(ctx, "hot", 8); e != nil {
+		t.Fatal(e)
+	}
+	for i := 0; i < 3; i++ {
+		if e := CounterIncrement(ctx, "hot"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var cfg counterConfig
+	ckey := datastore.NewKey(ctx, KindCounterConfig, "hot", 0, nil)
+	if e := datastore.Get(ctx, ckey, &cfg); e != nil || cfg.Shards != 20 {
+		t.Errorf("expect 20 shards; got %d (%v)", cfg.Shards, e)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	c1, err := MakeSessionCookie(ctx, "session", "refresh", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, err := RefreshSession(ctx, c1.Value, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Value != c1.Value || c2.Name != c1.Name {
+		t.Errorf("expect cookie %v=%v; got %v=%v", c1.Name, c1.Value, c2.Name, c2.Value)
+	}
+	if !c2.Expires.After(c1.Expires.Add(time.Hour - time.Minute - time.Second)) {
+		t.Errorf("expect expiry to be about an hour from now; got %v", c2.Expires)
+	}
+	if !c2.HttpOnly {
+		t.Error("expect refreshed cookie to be HttpOnly")
+	}
+	opts := SessionCookieOptions{
+		Domain:   "example.com",
+		HttpOnly: true,
+		Path:     "/",
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	}
+	c3, err := RefreshSessionOpts(ctx, c1.Value, 3600, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3.Domain != opts.Domain || !c3.HttpOnly || c3.Path != opts.Path ||
+		c3.SameSite != opts.SameSite || !c3.Secure {
+		t.Errorf("expect cookie attributes %+v; got %+v", opts, c3)
+	}
+	k, _ := datastore.DecodeKey(c1.Value)
+	var s Session
+	if e := datastore.Get(ctx, k, &s); e != nil {
+		t.Fatal(e)
+	}
+	if !s.Expiration.Truncate(time.Second).Equal(c2.Expires.Truncate(time.Second)) {
+		t.Errorf("expect stored expiration %v; got %v", c2.Expires, s.Expiration)
+	}
+	if !CheckSession(ctx, c1.Value) {
+		t.Error("expect refreshed session to be valid")
+	}
+
+	expired, err := MakeSessionCookie(ctx, "session", "expired", -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, e := RefreshSession(ctx, expired.Value, 60); !IsNotFoundError(e) {
+		t.Errorf("expect NotFoundError for expired session; got %v", e)
+	}
+	missing := datastore.NewKey(ctx, KindSession, "", 12345, nil).Encode()
+	if _, e := RefreshSession(ctx, missing, 60); !IsNotFoundError(e) {
+		t.Errorf("expect NotFoundError for missing session; got %v", e)
+	}
+	if _, e := RefreshSession(ctx, "invalid", 60); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed session ID; got %v", e)
+	}
+	other := datastore.NewKey(ctx, "Ointment", "", 12345, nil).Encode()
+	if _, e := RefreshSession(ctx, other, 60); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for key of another kind; got %v", e)
+	}
+}
+
+func TestCheckSessionRetry(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	c, err := MakeSessionCookie(ctx, "session", "fresh", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	memcache.Delete(ctx, c.Value) //force a Datastore lookup
+	if !CheckSessionRetry(ctx, c.Value, 5) {
+		t.Error("expect fresh session to be valid")
+	}
+
+	missing := datastore.NewKey(ctx, KindSession, "", 54321, nil).Encode()
+	start := time.Now()
+	if CheckSessionRetry(ctx, missing, 3) {
+		t.Error("expect missing session to be invalid")
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("expect lookups to be retried with backoff; took %v", d)
+	}
+	if CheckSessionRetry(ctx, "invalid", 3) {
+		t.Error("expect malformed session ID to be invalid")
+	}
+}
+
+func TestDestroySession(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	c, err := MakeSessionCookie(ctx, "session", "logout", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !CheckSession(ctx, c.Value) {
+		t.Fatal("expect new session to be valid")
+	}
+	if e := DestroySession(ctx, c.Value); e != nil {
+		t.Fatal(e)
+	}
+	if CheckSession(ctx, c.Value) {
+		t.Error("expect destroyed session to be invalid")
+	}
+	if e := DestroySession(ctx, c.Value); e != nil {
+		t.Errorf("expect destroying a session again to succeed; got %v", e)
+	}
+	if e := DestroySession(ctx, "invalid"); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed session ID; got %v", e)
+	}
+	other := datastore.NewKey(ctx, "Ointment", "", 12345, nil).Encode()
+	if e := DestroySession(ctx, other); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for key of another kind; got %v", e)
+	}
+}
+
+func TestPageMarshalJSON(t *testing.T) {
+	p := &Page{
+		Title:       "Home",
+		Description: "The home page",
+		Handler:     func(w http.ResponseWriter, r *http.Request) {},
+		Template:    "home.html",
+	}
+	p.AddVar("greeting", "Hello")
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]interface{}
+	if e := json.Unmarshal(b, &got); e != nil {
+		t.Fatal(e)
+	}
+	if got["title"] != "Home" || got["description"] != "The home page" {
+		t.Errorf("expect title and description; got %v", string(b))
+	}
+	dict, _ := got["dictionary"].(map[string]interface{})
+	if dict["greeting"] != "Hello" || dict["Title"] != "Home" {
+		t.Errorf("expect merged dictionary; got %v", got["dictionary"])
+	}
+	for _, field := range []string{"Handler", "handler", "Template", "template"} {
+		if _, ok := got[field]; ok {
+			t.Errorf("expect '%v' to be absent; got %v", field, string(b))
+		}
+	}
+}
+
+func TestGetSessionValue(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	type profile struct {
+		UserID int64    `json:"userId"`
+		Roles  []string `json:"roles"`
+	}
+	want := profile{UserID: 42, Roles: []string{"admin", "editor"}}
+	c, err := MakeSessionCookie(ctx, "session", want, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//from the cache and from the Datastore
+	for _, evict := range []bool{false, true} {
+		if evict {
+			memcache.Delete(ctx, c.Value)
+		}
+		var got profile
+		if e := GetSessionValue(ctx, c.Value, &got); e != nil {
+			t.Fatal(e)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("expect %v; got %v", want, got)
+		}
+	}
+
+	var n int
+	if e := GetSessionValue(ctx, c.Value, &n); !IsJSONUnmarshalError(e) {
+		t.Errorf("expect JSONUnmarshalError for wrong type; got %v", e)
+	}
+	expired, err := MakeSessionCookie(ctx, "session", want, -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := GetSessionValue(ctx, expired.Value, &profile{}); e != ErrUnauth {
+		t.Errorf("expect ErrUnauth for expired session; got %v", e)
+	}
+	missing := datastore.NewKey(ctx, KindSession, "", 67890, nil).Encode()
+	if e := GetSessionValue(ctx, missing, &profile{}); e != ErrUnauth {
+		t.Errorf("expect ErrUnauth for missing session; got %v", e)
+	}
+	if e := GetSessionValue(ctx, "invalid", &profile{}); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed session ID; got %v", e)
+	}
+	other := datastore.NewKey(ctx, "Ointment", "", 67890, nil).Encode()
+	if e := GetSessionValue(ctx, other, &profile{}); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for key of another kind; got %v", e)
+	}
+}
+
+func TestMakeSessionCookieOpts(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	c1, err := MakeSessionCookie(ctx, "session", "default", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c1.HttpOnly {
+		t.Error("expect default session cookie to be HttpOnly")
+	}
+
+	opts := SessionCookieOptions{
+		Domain:   "example.com",
+		HttpOnly: true,
+		Path:     "/app",
+		SameSite: http.SameSiteStrictMode,
+		Secure:   true,
+	}
+	c2, err := MakeSessionCookieOpts(ctx, "session", "opts", 60, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Domain != opts.Domain || c2.HttpOnly != opts.HttpOnly || c2.Path != opts.Path ||
+		c2.SameSite != opts.SameSite || c2.Secure != opts.Secure {
+		t.Errorf("expect cookie attributes %+v; got %+v", opts, c2)
+	}
+	if !CheckSession(ctx, c2.Value) {
+		t.Error("expect session to be valid")
+	}
+	if s := c2.String(); !strings.Contains(s, "SameSite=Strict") || !strings.Contains(s, "Secure") {
+		t.Errorf("expect serialised cookie to carry the attributes; got %v", s)
+	}
+}
+
+func TestDecodeSessionValues(t *testing.T) {
+	type visitor struct {
+		Name string `json:"name"`
+		Page string `json:"page"`
+	}
+	sessions := []*Session{
+		{Value: `{"name":"Alice","page":"/home"}`},
+		{Value: ""},
+		{Value: `{"name":"Bob","page":"/cart"}`},
+	}
+	var got []visitor
+	if e := DecodeSessionValues(sessions, &got); e != nil {
+		t.Fatal(e)
+	}
+	want := []visitor{{"Alice", "/home"}, {}, {"Bob", "/cart"}}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("expect %v; got %v", want, got)
+	}
+
+	if e := DecodeSessionValues(sessions, got); !IsTypeError(e) {
+		t.Errorf("expect TypeError for non-pointer; got %v", e)
+	}
+	bad := []*Session{{Value: `{"name":`}}
+	if e := DecodeSessionValues(bad, &got); !IsJSONUnmarshalError(e) {
+		t.Errorf("expect JSONUnmarshalError for malformed value; got %v", e)
+	}
+}
+
+func TestSessionFromRequest(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	c, err := MakeSessionCookie(ctx, "sid", "request", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	if valid, id := SessionFromRequest(ctx, r, "sid"); valid || id != "" {
+		t.Errorf("expect no session without cookie; got %v, '%v'", valid, id)
+	}
+	r.AddCookie(c)
+	if valid, id := SessionFromRequest(ctx, r, "sid"); !valid || id != c.Value {
+		t.Errorf("expect valid session '%v'; got %v, '%v'", c.Value, valid, id)
+	}
+	if valid, _ := SessionFromRequest(ctx, r, "other"); valid {
+		t.Error("expect no session for a different cookie name")
+	}
+}
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	active, err := MakeSessionCookie(ctx, "session", "active", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := make([]*http.Cookie, 3)
+	for i := range expired {
+		if expired[i], err = MakeSessionCookie(ctx, "session", "expired", -60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := PurgeExpiredSessions(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expect 2 sessions to be purged; got %d", n)
+	}
+	if n, err = PurgeExpiredSessions(ctx, 0); err != nil || n != 1 {
+		t.Errorf("expect 1 remaining session to be purged; got %d (%v)", n, err)
+	}
+	for _, c := range expired {
+		k, _ := datastore.DecodeKey(c.Value)
+		if e := datastore.Get(ctx, k, &Session{}); e != datastore.ErrNoSuchEntity {
+			t.Errorf("expect expired session to be deleted; got %v", e)
+		}
+	}
+	if !CheckSession(ctx, active.Value) {
+		t.Error("expect active session to be kept")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	inst, err := aetest.NewInstance(nil)
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+
+	h := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("database exploded")
+	}))
+	cases := []struct {
+		expose      bool
+		wantMessage string
+	}{
+		{false, "internal server error"},
+		{true, "database exploded"},
+	}
+	for _, c := range cases {
+		ExposeInternalErrors = c.expose
+		r, err := inst.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expect status 500; got %d", w.Code)
+		}
+		var er ErrorResponse
+		if e := json.Unmarshal(w.Body.Bytes(), &er); e != nil {
+			t.Fatalf("expect JSON body; got %v (%v)", w.Body.String(), e)
+		}
+		want := ErrorResponse{ErrorCode: "INTERNAL", Message: c.wantMessage}
+		if !want.Equal(er) {
+			t.Errorf("expect %v; got %v", want, er)
+		}
+	}
+	ExposeInternalErrors = false
+
+	//no panic
+	ok := Recover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	ok.ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("expect status 204; got %d", w.Code)
+	}
+}
+
+func TestRequireJSONFields(t *testing.T) {
+	body := []byte(`{"name": "Tiger Balm", "price": null}`)
+	ers := RequireJSONFields(body, "email", "name", "phone")
+	want := []ErrorResponse{
+		{ErrorCode: "MISSING", Field: "email", Message: "email is required"},
+		{ErrorCode: "MISSING", Field: "phone", Message: "phone is required"},
+	}
+	if len(ers) != len(want) {
+		t.Fatalf("expect %d errors; got %v", len(want), ers)
+	}
+	for i := range want {
+		if !want[i].Equal(ers[i]) {
+			t.Errorf("expect %v; got %v", want[i], ers[i])
+		}
+	}
+	//null value is present
+	if ers := RequireJSONFields(body, "name", "price"); len(ers) != 0 {
+		t.Errorf("expect no errors; got %v", ers)
+	}
+	//not an object
+	for _, b := range []string{`[1, 2]`, `null`, `{bad`} {
+		ers := RequireJSONFields([]byte(b), "name")
+		if len(ers) != 1 || ers[0].ErrorCode != "BAD_FORMAT" {
+			t.Errorf("expect BAD_FORMAT for %s; got %v", b, ers)
+		}
+	}
+}
+
+func TestSessionExpiresAtQuery(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	if _, err := MakeSessionCookie(ctx, "session", "active", 60); err != nil {
+		t.Fatal(err)
+	}
+	expired, err := MakeSessionCookie(ctx, "session", "expired", -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sessions []*Session
+	keys, err := datastore.NewQuery(KindSession).
+		Filter("ExpiresAt <", time.Now()).GetAll(ctx, &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("expect 1 expired session; got %d", len(keys))
+	}
+	if keys[0].Encode() != expired.Value {
+		t.Errorf("expect key %v; got %v", expired.Value, keys[0].Encode())
+	}
+	if !sessions[0].ExpiresAt.Equal(sessions[0].Expiration) {
+		t.Errorf("expect ExpiresAt %v; got %v", sessions[0].Expiration,
+			sessions[0].ExpiresAt)
+	}
+}
+
+func TestUpdateSessionValue(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	type cart struct {
+		Items []string `json:"items"`
+	}
+	c, err := MakeSessionCookie(ctx, "session", cart{Items: []string{"balm"}}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, _ := datastore.DecodeKey(c.Value)
+	var before Session
+	if e := datastore.Get(ctx, k, &before); e != nil {
+		t.Fatal(e)
+	}
+	if e := UpdateSessionValue(ctx, c.Value, cart{Items: []string{"balm", "oil"}}); e != nil {
+		t.Fatal(e)
+	}
+	var after Session
+	if e := datastore.Get(ctx, k, &after); e != nil {
+		t.Fatal(e)
+	}
+	if after.Value != `{"items":["balm","oil"]}` {
+		t.Errorf("expect updated value; got %v", after.Value)
+	}
+	if after.Name != before.Name {
+		t.Errorf("expect name %v; got %v", before.Name, after.Name)
+	}
+	if !after.Expiration.Equal(before.Expiration) {
+		t.Errorf("expect expiration %v; got %v", before.Expiration, after.Expiration)
+	}
+	var got cart
+	if e := GetSessionValue(ctx, c.Value, &got); e != nil {
+		t.Fatal(e)
+	}
+	if len(got.Items) != 2 {
+		t.Errorf("expect cached value to be updated; got %v", got)
+	}
+
+	missing := datastore.NewKey(ctx, KindSession, "", 12345, nil).Encode()
+	if e := UpdateSessionValue(ctx, missing, cart{}); !IsNotFoundError(e) {
+		t.Errorf("expect NotFoundError for missing session; got %v", e)
+	}
+	if e := UpdateSessionValue(ctx, "invalid", cart{}); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed session ID; got %v", e)
+	}
+	other := datastore.NewKey(ctx, "Ointment", "", 12345, nil).Encode()
+	if e := UpdateSessionValue(ctx, other, cart{}); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for key of another kind; got %v", e)
+	}
+}
+
+func TestMergeValidationErrors(t *testing.T) {
+	got := MergeValidationErrors(
+		[]string{"name is required", "price must be positive"},
+		nil,
+		[]string{"email is invalid", "name is required"},
+		[]string{"quantity is required"},
+	)
+	want := []string{"name is required", "price must be positive",
+		"email is invalid", "quantity is required"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expect %v; got %v", want, got)
+	}
+	if got := MergeValidationErrors(); got == nil || len(got) != 0 {
+		t.Errorf("expect empty slice; got %#v", got)
+	}
+}
+
+func TestSessionSigning(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	SessionSigningKey = []byte("session-secret")
+	defer func() { SessionSigningKey = nil }()
+
+	c, err := MakeSessionCookie(ctx, "session", "signed", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := strings.LastIndex(c.Value, ".")
+	if i < 0 {
+		t.Fatalf("expect signed session ID; got %v", c.Value)
+	}
+	if !CheckSession(ctx, c.Value) {
+		t.Error("expect signed session to be valid")
+	}
+	if got := ValidateSessions(ctx, []string{c.Value}); got[c.Value] == nil {
+		t.Errorf("expect signed session to be validated; got %v", got)
+	}
+
+	//the key of the session is valid but the signature is not
+	unsigned := c.Value[:i]
+	other, err := MakeSessionCookie(ctx, "session", "other", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []string{
+		unsigned,
+		unsigned + ".",
+		unsigned + other.Value[strings.LastIndex(other.Value, "."):],
+		c.Value + "x",
+	}
+	for _, id := range tampered {
+		if CheckSession(ctx, id) {
+			t.Errorf("expect tampered session ID %v to be rejected", id)
+		}
+		if e := GetSessionValue(ctx, id, new(string)); !IsInvalidError(e) {
+			t.Errorf("GetSessionValue: expect InvalidError for %v; got %v", id, e)
+		}
+		if e := DestroySession(ctx, id); !IsInvalidError(e) {
+			t.Errorf("DestroySession: expect InvalidError for %v; got %v", id, e)
+		}
+		if _, e := RefreshSession(ctx, id, 60); !IsInvalidError(e) {
+			t.Errorf("RefreshSession: expect InvalidError for %v; got %v", id, e)
+		}
+		if e := UpdateSessionValue(ctx, id, "new"); !IsInvalidError(e) {
+			t.Errorf("UpdateSessionValue: expect InvalidError for %v; got %v", id, e)
+		}
+		if _, e := VerifySession(ctx, id); !IsInvalidError(e) {
+			t.Errorf("VerifySession: expect InvalidError for %v; got %v", id, e)
+		}
+	}
+	if got := ValidateSessions(ctx, tampered); len(got) != 0 {
+		t.Errorf("expect tampered sessions to be omitted; got %v", got)
+	}
+
+	if e := DestroySession(ctx, c.Value); e != nil {
+		t.Fatal(e)
+	}
+	if CheckSession(ctx, c.Value) {
+		t.Error("expect destroyed session to be invalid")
+	}
+}
+
+func TestVerifySession(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	c, err := MakeSessionCookie(ctx, "session", "verify", 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := VerifySession(ctx, c.Value)
+	if err != nil {
+		t.Fatalf("expect valid session; got %v", err)
+	}
+	if s.Value != `"verify"` {
+		t.Errorf("expect session value %q; got %q", `"verify"`, s.Value)
+	}
+
+	expired, err := MakeSessionCookie(ctx, "session", "expired", -60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, e := VerifySession(ctx, expired.Value); !IsValidityError(e) {
+		t.Errorf("expect ValidityError for expired session; got %v", e)
+	}
+	missing := datastore.NewKey(ctx, KindSession, "", 12345, nil).Encode()
+	if _, e := VerifySession(ctx, missing); !IsNotFoundError(e) {
+		t.Errorf("expect NotFoundError for missing session; got %v", e)
+	}
+	if _, e := VerifySession(ctx, "invalid"); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for malformed session ID; got %v", e)
+	}
+	other := datastore.NewKey(ctx, "Ointment", "", 12345, nil).Encode()
+	if _, e := VerifySession(ctx, other); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for key of another kind; got %v", e)
+	}
+
+	SessionSigningKey = []byte("session-secret")
+	defer func() { SessionSigningKey = nil }()
+	if _, e := VerifySession(ctx, c.Value); !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for unsigned session ID; got %v", e)
+	}
+}
+
+func TestSaveAndCount(t *testing.T) {
+	inst, err := aetest.NewInstance(&aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create instance: %v", err)
+	}
+	defer inst.Close()
+	r, err := inst.NewRequest("GET", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := appengine.NewContext(r)
+
+	m := &Ointment{Name: "Tiger Balm"}
+	if e := SaveAndCount(ctx, m, "ointments"); e != nil {
+		t.Fatal(e)
+	}
+	var got Ointment
+	if e := datastore.Get(ctx, m.Key(), &got); e != nil {
+		t.Fatalf("expect entity to be saved; got %v", e)
+	}
+	if got.Name != "Tiger Balm" {
+		t.Errorf("expect name Tiger Balm; got %v", got.Name)
+	}
+	if n, e := CounterCountFresh(ctx, "ointments"); e != nil || n != 1 {
+		t.Errorf("expect count 1; got %d (%v)", n, e)
+	}
+
+	//invalid entity is not counted
+	if e := SaveAndCount(ctx, &Ointment{}, "ointments"); !IsValidityError(e) {
+		t.Errorf("expect ValidityError; got %v", e)
+	}
+	if n, e := CounterCountFresh(ctx, "ointments"); e != nil || n != 1 {
+		t.Errorf("expect count to remain 1; got %d (%v)", n, e)
+	}
+}
+
+func TestValidationErrorResponses(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	want := []ErrorResponse{{ErrorCode: "VALIDATION", Message: "Name is required"}}
+	m := &Ointment{}
+	got := ValidationErrorResponses(m)
+	if len(got) != len(want) || !want[0].Equal(got[0]) {
+		t.Errorf("expect %v; got %v", want, got)
+	}
+	if got := ValidationErrorResponses(&Ointment{Name: "Tiger Balm"}); len(got) != 0 {
+		t.Errorf("expect no errors for valid model; got %v", got)
+	}
+
+	e := Save(ctx, m)
+	ve, ok := e.(ValidityError)
+	if !ok {
+		t.Fatalf("expect ValidityError; got %v", e)
+	}
+	got = ve.ErrorResponses()
+	if len(got) != len(want) || !want[0].Equal(got[0]) {
+		t.Errorf("expect %v; got %v", want, got)
+	}
+
+	//several validation errors
+	want = []ErrorResponse{
+		{ErrorCode: "VALIDATION", Message: "Name is required"},
+		{ErrorCode: "VALIDATION", Message: "Price is invalid"},
+	}
+	got = ValidityError{"Name is required, Price is invalid"}.ErrorResponses()
+	if len(got) != len(want) || !want[0].Equal(got[0]) || !want[1].Equal(got[1]) {
+		t.Errorf("expect %v; got %v", want, got)
+	}
+
+	//the error remains comparable
+	if e != error(ValidityError{"Name is required"}) {
+		t.Errorf("expect error to equal the ValidityError; got %v", e)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	cases := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{"user@example.com", "user@example.com", false},
+		{"  John.Doe@Example.COM \n", "john.doe@example.com", false},
+		{"", "", true},
+		{"user", "", true},
+		{"user@", "", true},
+		{"@example.com", "", true},
+		{"user@@example.com", "", true},
+		{"John <john@example.com>", "", true},
+		{"a b@example.com", "", true},
+	}
+	for _, c := range cases {
+		got, err := NormalizeEmail(c.input)
+		if c.wantErr {
+			if !IsInvalidError(err) {
+				t.Errorf("expect InvalidError for %q; got %v", c.input, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expect no error for %q; got %v", c.input, err)
+		}
+		if got != c.want {
+			t.Errorf("expect %v; got %v", c.want, got)
+		}
+	}
+}
+
+func TestWriteJSONCollEmpty(t *testing.T) {
+	for _, coll := range [][]Datastorer{nil, {}} {
+		w := httptest.NewRecorder()
+		WriteJSONColl(w, coll, http.StatusOK, "cursorabc")
+		if w.Code != http.StatusOK {
+			t.Errorf("expect status 200; got %d", w.Code)
+		}
+		if got := w.Body.String(); got != "[]" {
+			t.Errorf("expect []; got %v", got)
+		}
+		if h := w.Header().Get(HeaderCursor); h != "cursorabc" {
+			t.Errorf("expect %v header cursorabc; got %q", HeaderCursor, h)
+		}
+	}
+}
+
+func TestAuthorizeSession(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	admin, err := MakeSessionCookie(ctx, "session", map[string]interface{}{
+		"userID": "u1",
+		"role":   "admin",
+	}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editor, err := MakeSessionCookie(ctx, "session", map[string]interface{}{
+		"userID": "u2",
+		"roles":  []string{"editor", "viewer"},
+	}, 60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, e := AuthorizeSession(ctx, admin.Value, "admin", "role"); !ok || e != nil {
+		t.Errorf("expect admin to be authorized; got %v (%v)", ok, e)
+	}
+	if ok, e := AuthorizeSession(ctx, editor.Value, "viewer", "roles"); !ok || e != nil {
+		t.Errorf("expect viewer to be authorized; got %v (%v)", ok, e)
+	}
+	if ok, e := AuthorizeSession(ctx, editor.Value, "admin", "roles"); ok || !IsUnauthorizedError(e) {
+		t.Errorf("expect UnauthorizedError for non-matching role; got %v (%v)", ok, e)
+	}
+	if ok, e := AuthorizeSession(ctx, admin.Value, "admin", "roles"); ok || !IsUnauthorizedError(e) {
+		t.Errorf("expect UnauthorizedError for missing role field; got %v (%v)", ok, e)
+	}
+	missing := datastore.NewKey(ctx, KindSession, "", 12345, nil).Encode()
+	if ok, e := AuthorizeSession(ctx, missing, "admin", "role"); ok || !IsNotFoundError(e) {
+		t.Errorf("expect NotFoundError for missing session; got %v (%v)", ok, e)
+	}
+}
+
+func TestWriteErrorResponseMarshalError(t *testing.T) {
+	er := ErrorResponse{
+		ErrorCode: "BAD_FORMAT",
+		Details:   map[string]interface{}{"callback": func() {}},
+	}
+	w := httptest.NewRecorder()
+	WriteErrorResponse(w, http.StatusBadRequest, er)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expect status 500; got %d", w.Code)
+	}
+	if w.Header().Get(HeaderError) == "" {
+		t.Errorf("expect %v header to be set", HeaderError)
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("expect empty body; got %v", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	WriteErrorResponse(w, http.StatusBadRequest, ErrorResponse{Message: "100% wrong"})
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expect status 400; got %d", w.Code)
+	}
+	if got := w.Body.String(); got != `{"message":"100% wrong"}` {
+		t.Errorf("expect the payload to be written as is; got %v", got)
+	}
+}
@@ -1,22 +1,52 @@
 package gae
 
 import (
+	"archive/zip"
+	"bufio"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/file"
 
 	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
 )
 
 // FolderSeparator is the slash ("/") that Google Cloud Storage uses to denote
 // an object as a folder.
 const FolderSeparator = "/"
 
+// uploadEndpoint is the Cloud Storage JSON API endpoint for initiating
+// uploads. It is a variable so that it can be pointed elsewhere in tests.
+var uploadEndpoint = "https://www.googleapis.com/upload/storage/v1/b/"
+
+// uploadClient creates the authorized HTTP client for initiating uploads. It
+// is a variable so that it can be replaced in tests.
+var uploadClient = func(ctx context.Context) (*http.Client, error) {
+	return google.DefaultClient(ctx, storage.ScopeReadWrite)
+}
+
+// defaultBucket caches the name of the default bucket once it has been
+// resolved so that NewGCStorage does not look it up on every call.
+var defaultBucket struct {
+	sync.Mutex
+	name string
+}
+
+// defaultBucketResolver looks up the name of the default bucket of the
+// application. It is a variable so that it can be replaced in tests.
+var defaultBucketResolver = file.DefaultBucketName
+
 // GCStorage utilises the API to access Google Cloud Storage.
 type GCStorage struct {
 	bucket     *storage.BucketHandle
@@ -25,6 +55,55 @@ type GCStorage struct {
 
 // RECEIVER definitions for GCStorage
 
+// Bucket gets the underlying bucket handle so that the features of Cloud
+// Storage that are not wrapped (e.g. notifications and IAM) can be used
+// without creating another client.
+func (gcs *GCStorage) Bucket() *storage.BucketHandle {
+	return gcs.bucket
+}
+
+// ContentType gets the MIME type of the object in Cloud Storage without
+// reading its contents.
+func (gcs *GCStorage) ContentType(ctx context.Context, name string) (string, error) {
+	if gcs.bucket == nil {
+		return "", NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	attrs, err := gcs.bucket.Object(name).Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	return attrs.ContentType, nil
+}
+
+// CopyFolder copies all the objects under `srcPrefix` to `dstPrefix`,
+// returning the number of objects copied.
+//
+// The name of each copy is the name of the source object with `srcPrefix`
+// replaced by `dstPrefix`. The copy is performed on the server side so the
+// contents do not pass through the application.
+//
+// If any copy fails, the error is returned along with the number of objects
+// copied before the failure.
+func (gcs *GCStorage) CopyFolder(ctx context.Context, srcPrefix,
+	dstPrefix string) (int, error) {
+	results, err := gcs.ListFiles(ctx, srcPrefix)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, res := range results {
+		src := gcs.bucket.Object(res.Name)
+		dst := gcs.bucket.Object(dstPrefix + strings.TrimPrefix(res.Name, srcPrefix))
+		if _, e := dst.CopierFrom(src).Run(ctx); e != nil {
+			return n, e
+		}
+		n++
+	}
+	return n, nil
+}
+
 // CreateFolder creates an empty folder in Cloud Storage. This is akin to the
 // "mkdir" command in Bash.
 //
@@ -49,6 +128,74 @@ func (gcs *GCStorage) CreateFolder(ctx context.Context, name string) error {
 	return nil
 }
 
+// CreateResumableUpload initiates a resumable upload session for the object
+// and returns the session URI.
+//
+// The client can then upload the contents directly to Cloud Storage by
+// sending PUT requests (in one or more chunks) to the session URI, without
+// the data passing through the application. The `mime` parameter is the
+// content type of the object to be uploaded.
+//
+// Use CreateResumableUploadOrigin if the upload is made from a browser.
+func (gcs *GCStorage) CreateResumableUpload(ctx context.Context, name,
+	mime string) (string, error) {
+	return gcs.CreateResumableUploadOrigin(ctx, name, mime, "")
+}
+
+// CreateResumableUploadOrigin initiates a resumable upload session in the
+// same way as CreateResumableUpload, but also sends `origin` as the Origin
+// header if it is not empty.
+//
+// `origin` is the origin of the page making the upload (e.g.
+// "https://www.example.com"), as Cloud Storage only applies the CORS
+// configuration of the bucket to the session URI if the session was
+// initiated with an Origin header.
+func (gcs *GCStorage) CreateResumableUploadOrigin(ctx context.Context, name,
+	mime, origin string) (string, error) {
+	if gcs.bucket == nil {
+		return "", NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	if name == "" {
+		return "", MissingError{
+			Msg: "object name",
+		}
+	}
+	client, err := uploadClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	u := uploadEndpoint + url.PathEscape(gcs.bucketName) +
+		"/o?uploadType=resumable&name=" + url.QueryEscape(name)
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return "", err
+	}
+	if mime != "" {
+		req.Header.Set("X-Upload-Content-Type", mime)
+	}
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unable to initiate resumable upload for '%v': %v",
+			name, resp.Status)
+	}
+	loc := resp.Header.Get("Location")
+	if loc == "" {
+		return "", MissingError{
+			Msg: "session URI in resumable upload response",
+		}
+	}
+	return loc, nil
+}
+
 // Delete deletes an object from Cloud Storage.
 //
 // This can delete both a file or "folder", noting that the concept of a
@@ -66,6 +213,76 @@ func (gcs *GCStorage) Delete(ctx context.Context, objName string) error {
 	return nil
 }
 
+// DeleteIfGeneration deletes the object from Cloud Storage only if its
+// generation is `gen`. This prevents deleting an object that has been
+// replaced by someone else since its generation was read (e.g. from
+// `storage.ObjectAttrs.Generation`).
+//
+// A ConflictError is returned if the generation does not match.
+func (gcs *GCStorage) DeleteIfGeneration(ctx context.Context, name string, gen int64) error {
+	if gcs.bucket == nil {
+		return NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	obj := gcs.bucket.Object(name).If(storage.Conditions{GenerationMatch: gen})
+	err := obj.Delete(ctx)
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+		return ConflictError{
+			Msg: fmt.Sprintf("generation of '%v' is not %d", name, gen),
+			Err: err,
+		}
+	}
+	return err
+}
+
+// DeleteMany deletes the named objects from Cloud Storage.
+//
+// An object that does not exist is treated as already deleted. All the
+// objects are attempted even if some of them fail, in which case an
+// `appengine.MultiError` is returned; its elements correspond to `names`,
+// with nil for those that were deleted successfully.
+func (gcs *GCStorage) DeleteMany(ctx context.Context, names []string) error {
+	if gcs.bucket == nil {
+		return NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	merr := make(appengine.MultiError, len(names))
+	failed := false
+	for i, name := range names {
+		e := gcs.bucket.Object(name).Delete(ctx)
+		if e != nil && e != storage.ErrObjectNotExist {
+			merr[i] = e
+			failed = true
+		}
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+// EnsureFolder creates an empty folder in Cloud Storage if it does not
+// already exist. This is akin to the "mkdir -p" command in Bash.
+//
+// Unlike CreateFolder, no error is returned if the folder already exists.
+func (gcs *GCStorage) EnsureFolder(ctx context.Context, name string) error {
+	if gcs.bucket == nil {
+		return NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	_, err := gcs.bucket.Object(name).Attrs(ctx)
+	if err == nil {
+		return nil
+	}
+	if err != storage.ErrObjectNotExist {
+		return err
+	}
+	return gcs.CreateFolder(ctx, name)
+}
+
 // GetBucketName gets the name of the bucket
 func (gcs *GCStorage) GetBucketName() string {
 	return gcs.bucketName
@@ -121,11 +338,50 @@ func (gcs *GCStorage) ListFilesAsString(ctx context.Context, foldername string)
 	return names, nil
 }
 
+// ListWithURLs lists the objects with the prefix and maps the full name of
+// each object to its public URL (see `PublicURL`).
+//
+// The URLs are only accessible if the objects are publicly readable.
+func (gcs *GCStorage) ListWithURLs(ctx context.Context, prefix string) (map[string]string, error) {
+	results, err := gcs.ListFiles(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	urls := make(map[string]string, len(results))
+	for _, res := range results {
+		urls[res.Name] = gcs.PublicURL(res.Name)
+	}
+	return urls, nil
+}
+
+// PublicURL gets the public URL of the object in the format
+//
+//	https://storage.googleapis.com/<bucket>/<name>
+//
+// Each segment of the name is escaped, but the folder separators are kept.
+func (gcs *GCStorage) PublicURL(name string) string {
+	segments := strings.Split(name, FolderSeparator)
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	return "https://storage.googleapis.com/" + gcs.bucketName + "/" +
+		strings.Join(segments, FolderSeparator)
+}
+
 // ReadFile reads the contents of the object in Cloud Storage.
 //
 // Note that the full "path" of the object must be specified.
+//
+// If the object does not exist, a NotFoundError of the kind "object" is
+// returned, wrapping `storage.ErrObjectNotExist`.
 func (gcs *GCStorage) ReadFile(ctx context.Context, name string) ([]byte, error) {
 	rc, err := gcs.bucket.Object(name).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, NotFoundError{
+			Kind: "object",
+			Err:  err,
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -137,6 +393,146 @@ func (gcs *GCStorage) ReadFile(ctx context.Context, name string) ([]byte, error)
 	return in, nil
 }
 
+// ServeFileRange writes the object in Cloud Storage to the response,
+// honouring the "Range" header of the request so that clients can seek (e.g.
+// in videos).
+//
+// A single byte range (e.g. "bytes=0-499", "bytes=500-" or "bytes=-500") is
+// served as 206 Partial Content with the "Content-Range" header. If the range
+// cannot be satisfied, 416 Requested Range Not Satisfiable is written. The
+// full object is served as 200 OK if there is no "Range" header, if it
+// specifies multiple ranges or if its unit is not "bytes" (as required by RFC
+// 7233).
+//
+// If the object does not exist, a NotFoundError of the kind "object" is
+// returned without writing to the response.
+func (gcs *GCStorage) ServeFileRange(ctx context.Context, w http.ResponseWriter,
+	r *http.Request, name string) error {
+	if gcs.bucket == nil {
+		return NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	obj := gcs.bucket.Object(name)
+	attrs, err := obj.Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return NotFoundError{
+			Kind: "object",
+			Err:  err,
+		}
+	}
+	if err != nil {
+		return err
+	}
+	start, length, partial, ok := parseByteRange(r.Header.Get("Range"), attrs.Size)
+	if !ok {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", attrs.Size))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	}
+	rc, err := obj.NewRangeReader(ctx, start, length)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if attrs.ContentType != "" {
+		w.Header().Set("Content-Type", attrs.ContentType)
+	}
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range",
+			fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, attrs.Size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	_, err = io.Copy(w, rc)
+	return err
+}
+
+// StreamZip writes a zip archive of all the objects under `prefix` to `w`.
+//
+// The name of each entry in the archive is the name of the object less the
+// prefix. The contents of the objects are streamed into the archive one at a
+// time so they are not held in memory in their entirety.
+//
+// Note that if an error occurs midway, a partial archive would already have
+// been written to `w`.
+func (gcs *GCStorage) StreamZip(ctx context.Context, w io.Writer, prefix string) error {
+	results, err := gcs.ListFiles(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	for _, res := range results {
+		name := strings.TrimPrefix(res.Name, prefix)
+		if name == "" { //the folder itself
+			continue
+		}
+		fw, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: res.Updated,
+		})
+		if err != nil {
+			return err
+		}
+		rc, err := gcs.bucket.Object(res.Name).NewReader(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// WriteFromRequest writes the body of the request to an object in Cloud
+// Storage, returning the attributes of the created object.
+//
+// The body is streamed to the object as it is read, so this is suitable for
+// requests where the raw file is sent as the body (i.e. not a multipart
+// form). The MIME type of the object is taken from the "Content-Type" header
+// of the request. If it is absent, the type is detected from the first 512
+// bytes of the body.
+func (gcs *GCStorage) WriteFromRequest(ctx context.Context, r *http.Request,
+	name string) (*storage.ObjectAttrs, error) {
+	if gcs.bucket == nil {
+		return nil, NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	if r.Body == nil {
+		return nil, NilError{
+			Msg: "request body is nil",
+		}
+	}
+	defer r.Body.Close()
+	br := bufio.NewReaderSize(r.Body, 512)
+	mime := r.Header.Get("Content-Type")
+	if mime == "" {
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		mime = http.DetectContentType(head)
+	}
+	wc := gcs.bucket.Object(name).NewWriter(ctx)
+	wc.ContentType = mime
+	if _, e := io.Copy(wc, br); e != nil {
+		wc.CloseWithError(e)
+		return nil, e
+	}
+	if e := wc.Close(); e != nil {
+		return nil, e
+	}
+	return wc.Attrs(), nil
+}
+
 // WriteFile writes a file to Cloud Storage.
 //
 // It reads the bytes from the provided `src` Reader and writes them to the
@@ -163,12 +559,45 @@ func (gcs *GCStorage) WriteFile(ctx context.Context, name string,
 	return nil
 }
 
+// WriteFileMax writes a file to Cloud Storage in the same way as WriteFile,
+// but streams the bytes from `src` instead of reading them all into memory
+// first, and aborts once more than `maxBytes` bytes are read, e.g. to guard
+// against oversized uploads.
+//
+// If the limit is exceeded, the upload is cancelled and an InvalidError is
+// returned. The aborted upload is never committed, so an existing object with
+// the same name is left intact.
+func (gcs *GCStorage) WriteFileMax(ctx context.Context, name string,
+	src io.Reader, mime string, maxBytes int64) error {
+	if gcs.bucket == nil {
+		return NilError{
+			Msg: "bucket is nil",
+		}
+	}
+	wc := gcs.bucket.Object(name).NewWriter(ctx)
+	wc.ContentType = mime
+	n, err := io.Copy(wc, io.LimitReader(src, maxBytes+1))
+	if err == nil && n > maxBytes {
+		err = InvalidError{
+			Msg: fmt.Sprintf("'%v' exceeds the limit of %d bytes", name, maxBytes),
+		}
+	}
+	if err != nil {
+		wc.CloseWithError(err)
+		return err
+	}
+	return wc.Close()
+}
+
 // GENERAL function definitions
 
 // NewGCStorage creates a new Google Cloud Storage client.
 //
 // The client has to be created from the caller so that it may be closed on a
 // per request basis.
+//
+// If bucketName is empty, the default bucket of the application is used. Its
+// name is looked up once and reused for subsequent calls.
 func NewGCStorage(ctx context.Context, client *storage.Client,
 	bucketName string) (GCStorage, error) {
 	gcs := GCStorage{}
@@ -178,7 +607,7 @@ func NewGCStorage(ctx context.Context, client *storage.Client,
 		}
 	}
 	if bucketName == "" {
-		bname, err := file.DefaultBucketName(ctx)
+		bname, err := defaultBucketName(ctx)
 		if err != nil {
 			return gcs, err
 		}
@@ -189,3 +618,65 @@ func NewGCStorage(ctx context.Context, client *storage.Client,
 	gcs.bucket = client.Bucket(gcs.bucketName)
 	return gcs, nil
 }
+
+// defaultBucketName returns the cached name of the default bucket, resolving
+// it if it has not been successfully looked up before.
+func defaultBucketName(ctx context.Context) (string, error) {
+	defaultBucket.Lock()
+	defer defaultBucket.Unlock()
+	if defaultBucket.name != "" {
+		return defaultBucket.name, nil
+	}
+	bname, err := defaultBucketResolver(ctx)
+	if err != nil {
+		return "", err
+	}
+	defaultBucket.name = bname
+	return bname, nil
+}
+
+// parseByteRange parses the value of the "Range" header for an object of the
+// specified size, returning the offset and length of the bytes to serve and
+// whether it is a partial range. A missing header, one with multiple ranges
+// or one with a unit other than "bytes" is treated as a request for the whole
+// object.
+//
+// ok is false if the range is malformed or cannot be satisfied.
+func parseByteRange(header string, size int64) (start, length int64, partial, ok bool) {
+	if header == "" || strings.Contains(header, ",") {
+		return 0, size, false, true
+	}
+	if !strings.HasPrefix(header, "bytes=") { //unknown unit is ignored
+		return 0, size, false, true
+	}
+	parts := strings.SplitN(strings.TrimPrefix(header, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false, false
+	}
+	first, last := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if first == "" { //suffix range, e.g. "bytes=-500"
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, size > 0
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true, true
+}
@@ -1,11 +1,18 @@
 package gae
 
 import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 
 	"cloud.google.com/go/storage"
+	"golang.org/x/net/context"
 
 	"google.golang.org/appengine/aetest"
 )
@@ -221,3 +228,719 @@ func TestStorageCreateFolder(t *testing.T) {
 		log.Printf("  Done.")
 	}
 }
+
+func TestStorageCreateResumableUpload(t *testing.T) {
+	wantOrigin := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			t.Errorf("expect method POST; got %v", r.Method)
+		}
+		if got := r.URL.Query().Get("uploadType"); got != "resumable" {
+			t.Errorf("expect uploadType 'resumable'; got '%v'", got)
+		}
+		if got := r.Header.Get("X-Upload-Content-Type"); got != "image/png" {
+			t.Errorf("expect upload content type 'image/png'; got '%v'", got)
+		}
+		if got := r.Header.Get("Origin"); got != wantOrigin {
+			t.Errorf("expect origin '%v'; got '%v'", wantOrigin, got)
+		}
+		w.Header().Set("Location", "https://storage.example.com/upload?upload_id="+
+			r.URL.Query().Get("name"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer ts.Close()
+
+	origEndpoint, origClient := uploadEndpoint, uploadClient
+	defer func() {
+		uploadEndpoint, uploadClient = origEndpoint, origClient
+	}()
+	uploadEndpoint = ts.URL + "/"
+	uploadClient = func(ctx context.Context) (*http.Client, error) {
+		return ts.Client(), nil
+	}
+
+	ctx := context.Background()
+	gcs := GCStorage{}
+	if _, e := gcs.CreateResumableUpload(ctx, "a.png", "image/png"); !IsNilError(e) {
+		t.Errorf("expect NilError for nil bucket; got %v", e)
+	}
+	gcs = GCStorage{
+		bucket:     &storage.BucketHandle{},
+		bucketName: BucketName,
+	}
+	if _, e := gcs.CreateResumableUpload(ctx, "", "image/png"); !IsMissingError(e) {
+		t.Errorf("expect MissingError for empty name; got %v", e)
+	}
+	uri, err := gcs.CreateResumableUpload(ctx, "images/a.png", "image/png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(uri)
+	if err != nil {
+		t.Fatalf("expect session URI to be well-formed; got error %v", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		t.Errorf("expect session URI to be an absolute URL; got '%v'", uri)
+	}
+	if got := u.Query().Get("upload_id"); got != "images/a.png" {
+		t.Errorf("expect session URI for 'images/a.png'; got '%v'", got)
+	}
+
+	wantOrigin = "https://www.example.com"
+	if _, e := gcs.CreateResumableUploadOrigin(ctx, "images/b.png", "image/png",
+		wantOrigin); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestStorageCopyFolder(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"one.txt": "first file",
+		"two.txt": "second file",
+	}
+	for name, contents := range files {
+		if e := gc1.WriteFile(ctx, "copysrc/"+name,
+			strings.NewReader(contents), "text/plain"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	n, err := gc1.CopyFolder(ctx, "copysrc/", "copydst/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != n {
+		t.Errorf("expect %d objects to be copied; got %d", len(files), n)
+	}
+	got, err := gc1.ListFilesAsString(ctx, "copydst/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(got) {
+		t.Errorf("expect destination to have %d objects; got %v", len(files), got)
+	}
+	for name, contents := range files {
+		data, err := gc1.ReadFile(ctx, "copydst/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if contents != string(data) {
+			t.Errorf("expect contents of '%v' to be '%v'; got '%v'",
+				name, contents, string(data))
+		}
+		for _, folder := range []string{"copysrc/", "copydst/"} {
+			if e := gc1.Delete(ctx, folder+name); e != nil {
+				t.Fatal(e)
+			}
+		}
+	}
+}
+
+func TestStorageContentType(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "contenttype/plain.txt"
+	if e := gc1.WriteFile(ctx, name, strings.NewReader("plain"), "text/plain"); e != nil {
+		t.Fatal(e)
+	}
+	got, err := gc1.ContentType(ctx, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "text/plain" {
+		t.Errorf("expect content type of '%v' to be 'text/plain'; got '%v'", name, got)
+	}
+	if e := gc1.Delete(ctx, name); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := gc1.ContentType(ctx, name); e == nil {
+		t.Errorf("expect error for deleted object '%v'; got nil", name)
+	}
+}
+
+func TestStorageEnsureFolder(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "ensured/"
+	for i := 0; i < 2; i++ {
+		if e := gc1.EnsureFolder(ctx, name); e != nil {
+			t.Fatalf("attempt %d: expect no error ensuring '%v'; got %v", i+1, name, e)
+		}
+	}
+	if _, e := gc1.ReadFile(ctx, name); e != nil {
+		t.Errorf("expect folder '%v' to exist; got error %v", name, e)
+	}
+	if e := gc1.EnsureFolder(ctx, "ensured"); e == nil {
+		t.Error("expect error ensuring non-folder object; got nil")
+	}
+	if e := gc1.Delete(ctx, name); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestStorageStreamZip(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := "zipsrc/"
+	files := map[string]string{
+		"one.txt": "first file",
+		"two.txt": "second file",
+	}
+	if e := gc1.CreateFolder(ctx, folder); e != nil {
+		t.Fatal(e)
+	}
+	for name, contents := range files {
+		if e := gc1.WriteFile(ctx, folder+name,
+			strings.NewReader(contents), "text/plain"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	var buf bytes.Buffer
+	if e := gc1.StreamZip(ctx, &buf, folder); e != nil {
+		t.Fatal(e)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(zr.File) {
+		t.Errorf("expect archive to have %d entries; got %d", len(files), len(zr.File))
+	}
+	for _, f := range zr.File {
+		want, ok := files[f.Name]
+		if !ok {
+			t.Errorf("unexpected entry '%v' in archive", f.Name)
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != string(data) {
+			t.Errorf("expect contents of entry '%v' to be '%v'; got '%v'",
+				f.Name, want, string(data))
+		}
+	}
+	for name := range files {
+		if e := gc1.Delete(ctx, folder+name); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := gc1.Delete(ctx, folder); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func TestStorageDeleteMany(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"deletemany/one.txt", "deletemany/two.txt"}
+	for _, name := range names {
+		if e := gc1.WriteFile(ctx, name, strings.NewReader(name), "text/plain"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := gc1.DeleteMany(ctx, append(names, "deletemany/missing.txt")); e != nil {
+		t.Fatalf("expect no error deleting objects; got %v", e)
+	}
+	got, err := gc1.ListFilesAsString(ctx, "deletemany/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expect all objects to be deleted; got %v", got)
+	}
+}
+
+func TestStorageWriteFromRequest(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name     string
+		body     string
+		mime     string
+		wantMime string
+	}{
+		{
+			name:     "upload/explicit.csv",
+			body:     "a,b,c",
+			mime:     "text/csv",
+			wantMime: "text/csv",
+		},
+		{
+			name:     "upload/sniffed.html",
+			body:     "<html><body>sniffed</body></html>",
+			wantMime: "text/html; charset=utf-8",
+		},
+	}
+	for _, c := range cases {
+		var attrs *storage.ObjectAttrs
+		handler := func(w http.ResponseWriter, r *http.Request) {
+			var e error
+			attrs, e = gc1.WriteFromRequest(ctx, r, c.name)
+			if e != nil {
+				WriteRespErr(w, http.StatusInternalServerError, e)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+		r := httptest.NewRequest("POST", "/upload", strings.NewReader(c.body))
+		if c.mime != "" {
+			r.Header.Set("Content-Type", c.mime)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("%v: expect status %d; got %d (%v)", c.name,
+				http.StatusCreated, w.Code, w.Header().Get(HeaderError))
+		}
+		if attrs == nil || attrs.Name != c.name {
+			t.Errorf("%v: expect attributes of the object; got %+v", c.name, attrs)
+		}
+		data, err := gc1.ReadFile(ctx, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.body != string(data) {
+			t.Errorf("%v: expect contents '%v'; got '%v'", c.name, c.body, string(data))
+		}
+		mime, err := gc1.ContentType(ctx, c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.wantMime != mime {
+			t.Errorf("%v: expect content type '%v'; got '%v'", c.name, c.wantMime, mime)
+		}
+		if e := gc1.Delete(ctx, c.name); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func TestStorageDefaultBucketCache(t *testing.T) {
+	origResolver := defaultBucketResolver
+	defer func() {
+		defaultBucketResolver = origResolver
+		defaultBucket.name = ""
+	}()
+	calls := 0
+	defaultBucketResolver = func(ctx context.Context) (string, error) {
+		calls++
+		return BucketName, nil
+	}
+	defaultBucket.name = ""
+
+	ctx := context.Background()
+	client := &storage.Client{}
+	gc1, err := NewGCStorage(ctx, client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gc2, err := NewGCStorage(ctx, client, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gc1.GetBucketName() != BucketName || gc2.GetBucketName() != BucketName {
+		t.Errorf("expect bucket '%v'; got '%v' and '%v'", BucketName,
+			gc1.GetBucketName(), gc2.GetBucketName())
+	}
+	if calls != 1 {
+		t.Errorf("expect default bucket to be looked up once; got %d", calls)
+	}
+}
+
+func TestStorageReadFileNotFound(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gc1.ReadFile(ctx, "missing/nothing-here.txt")
+	if !IsNotFoundError(err) {
+		t.Fatalf("expect NotFoundError; got %v", err)
+	}
+	if nf := err.(NotFoundError); nf.Kind != "object" || nf.Err != storage.ErrObjectNotExist {
+		t.Errorf("expect NotFoundError for 'object' wrapping ErrObjectNotExist; got %v", err)
+	}
+}
+
+func TestStorageServeFileRange(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "rangetest/digits.txt"
+	body := "0123456789"
+	if e := gc1.WriteFile(ctx, name, strings.NewReader(body), "text/plain"); e != nil {
+		t.Fatal(e)
+	}
+	defer gc1.Delete(ctx, name)
+
+	cases := []struct {
+		rangeHdr      string
+		wantStatus    int
+		wantBody      string
+		wantContRange string
+	}{
+		{"", http.StatusOK, body, ""},
+		{"bytes=2-5", http.StatusPartialContent, "2345", "bytes 2-5/10"},
+		{"bytes=7-", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"bytes=-3", http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"bytes=20-30", http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"items=2-5", http.StatusOK, body, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/files/digits.txt", nil)
+		if c.rangeHdr != "" {
+			r.Header.Set("Range", c.rangeHdr)
+		}
+		w := httptest.NewRecorder()
+		if e := gc1.ServeFileRange(ctx, w, r, name); e != nil {
+			t.Fatalf("%v: %v", c.rangeHdr, e)
+		}
+		if c.wantStatus != w.Code {
+			t.Errorf("'%v': expect status %d; got %d", c.rangeHdr, c.wantStatus, w.Code)
+		}
+		if got := w.Body.String(); c.wantBody != got {
+			t.Errorf("'%v': expect body '%v'; got '%v'", c.rangeHdr, c.wantBody, got)
+		}
+		if got := w.Header().Get("Content-Range"); c.wantContRange != got {
+			t.Errorf("'%v': expect Content-Range '%v'; got '%v'", c.rangeHdr, c.wantContRange, got)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/files/nothing.txt", nil)
+	if e := gc1.ServeFileRange(ctx, w, r, "rangetest/nothing.txt"); !IsNotFoundError(e) {
+		t.Errorf("expect NotFoundError; got %v", e)
+	}
+}
+
+func TestParseByteRange(t *testing.T) {
+	cases := []struct {
+		header      string
+		wantStart   int64
+		wantLength  int64
+		wantPartial bool
+		wantOK      bool
+	}{
+		{"", 0, 100, false, true},
+		{"bytes=0-0", 0, 1, true, true},
+		{"bytes=10-19", 10, 10, true, true},
+		{"bytes=90-200", 90, 10, true, true},
+		{"bytes=-10", 90, 10, true, true},
+		{"bytes=-200", 0, 100, true, true},
+		{"bytes=0-9,20-29", 0, 100, false, true},
+		{"bytes=100-", 0, 0, false, false},
+		{"bytes=19-10", 0, 0, false, false},
+		{"items=0-9", 0, 100, false, true},
+		{"bytes=abc", 0, 0, false, false},
+	}
+	for _, c := range cases {
+		start, length, partial, ok := parseByteRange(c.header, 100)
+		if c.wantStart != start || c.wantLength != length ||
+			c.wantPartial != partial || c.wantOK != ok {
+			t.Errorf("'%v': expect %d, %d, %v, %v; got %d, %d, %v, %v", c.header,
+				c.wantStart, c.wantLength, c.wantPartial, c.wantOK,
+				start, length, partial, ok)
+		}
+	}
+}
+
+func TestStorageDeleteIfGeneration(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "generationtest/file.txt"
+	if e := gc1.WriteFile(ctx, name, strings.NewReader("one"), "text/plain"); e != nil {
+		t.Fatal(e)
+	}
+	attrs, err := client.Bucket(BucketName).Object(name).Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := attrs.Generation
+	//replace the object, which changes its generation
+	if e := gc1.WriteFile(ctx, name, strings.NewReader("two"), "text/plain"); e != nil {
+		t.Fatal(e)
+	}
+	if e := gc1.DeleteIfGeneration(ctx, name, stale); !IsConflictError(e) {
+		t.Errorf("expect ConflictError for stale generation; got %v", e)
+	}
+	attrs, err = client.Bucket(BucketName).Object(name).Attrs(ctx)
+	if err != nil {
+		t.Fatalf("expect object to still exist; got %v", err)
+	}
+	if e := gc1.DeleteIfGeneration(ctx, name, attrs.Generation); e != nil {
+		t.Errorf("expect delete with current generation to succeed; got %v", e)
+	}
+}
+
+func TestStorageListWithURLs(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"gallery/one.png", "gallery/two three.png"}
+	for _, name := range names {
+		if e := gc1.WriteFile(ctx, name, strings.NewReader(name), "image/png"); e != nil {
+			t.Fatal(e)
+		}
+	}
+	defer gc1.DeleteMany(ctx, names) //ignore any error
+
+	got, err := gc1.ListWithURLs(ctx, "gallery/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"gallery/one.png":       "https://storage.googleapis.com/" + BucketName + "/gallery/one.png",
+		"gallery/two three.png": "https://storage.googleapis.com/" + BucketName + "/gallery/two%20three.png",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expect %d objects; got %v", len(want), got)
+	}
+	for name, u := range want {
+		if got[name] != u {
+			t.Errorf("expect URL of %v to be %v; got %v", name, u, got[name])
+		}
+	}
+}
+
+func TestStoragePublicURL(t *testing.T) {
+	gcs := &GCStorage{bucketName: BucketName}
+	want := "https://storage.googleapis.com/" + BucketName + "/a%20b/c%3Fd.txt"
+	if got := gcs.PublicURL("a b/c?d.txt"); got != want {
+		t.Errorf("expect %v; got %v", want, got)
+	}
+}
+
+func TestStorageWriteFileMax(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	under := "writemax/under.txt"
+	if e := gc1.WriteFileMax(ctx, under, strings.NewReader("0123456789"),
+		"text/plain", 10); e != nil {
+		t.Fatalf("expect no error for stream within limit; got %v", e)
+	}
+	defer gc1.Delete(ctx, under) //ignore any error
+	b, err := gc1.ReadFile(ctx, under)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "0123456789" {
+		t.Errorf("expect 0123456789; got %s", b)
+	}
+
+	over := "writemax/over.txt"
+	e := gc1.WriteFileMax(ctx, over, strings.NewReader("0123456789A"),
+		"text/plain", 10)
+	if !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for stream over limit; got %v", e)
+	}
+	if _, e := gc1.ReadFile(ctx, over); !IsNotFoundError(e) {
+		t.Errorf("expect object over limit to not exist; got %v", e)
+	}
+
+	//a rejected write must not remove an existing object of the same name
+	e = gc1.WriteFileMax(ctx, under, strings.NewReader("0123456789A"),
+		"text/plain", 10)
+	if !IsInvalidError(e) {
+		t.Errorf("expect InvalidError for overwrite over limit; got %v", e)
+	}
+	b, err = gc1.ReadFile(ctx, under)
+	if err != nil {
+		t.Fatalf("expect existing object to survive; got %v", err)
+	}
+	if string(b) != "0123456789" {
+		t.Errorf("expect existing content 0123456789; got %s", b)
+	}
+}
+
+func TestStorageBucket(t *testing.T) {
+	ctx, done, err := aetest.NewContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer done()
+
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	gc1, err := NewGCStorage(ctx, client, BucketName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := gc1.Bucket()
+	if b == nil {
+		t.Fatal("expect bucket handle to be non-nil")
+	}
+	name := "bucket/raw.txt"
+	if e := gc1.WriteFile(ctx, name, strings.NewReader("raw"), "text/plain"); e != nil {
+		t.Fatal(e)
+	}
+	defer gc1.Delete(ctx, name) //ignore any error
+	attrs, err := b.Object(name).Attrs(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attrs.Name != name || attrs.Bucket != BucketName {
+		t.Errorf("expect %v/%v; got %v/%v", BucketName, name, attrs.Bucket,
+			attrs.Name)
+	}
+}